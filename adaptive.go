@@ -0,0 +1,209 @@
+package traefik_cluster_ratelimit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// the factor grows back by 5% of the average per interval...
+	adaptiveIncrease = 0.05
+	// ... and is halved when the upstream is unhealthy
+	adaptiveDecrease = 0.5
+	// maximum number of latencies kept per interval, to compute the percentile
+	adaptiveSamples = 1000
+	// the error rate is not meaningful below this number of requests
+	adaptiveMinRequests = 10
+)
+
+// statusResponseWriter captures the status code of the response
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps the streamed responses working
+func (w *statusResponseWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack keeps the websockets working. The hijacked connections count as
+// switching protocols
+func (w *statusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T is not a http.Hijacker", w.ResponseWriter)
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap is used by http.ResponseController
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// adaptiveLimit scales the rate limit with the health of the upstream. The
+// factor is shared by all the instances through Redis
+type adaptiveLimit struct {
+	limiter      *Limiter
+	metrics      *Metrics
+	floor        float64
+	ceiling      float64
+	maxErrorRate float64
+	maxLatency   time.Duration
+	percentile   float64
+	interval     time.Duration
+
+	mu        sync.Mutex
+	factor    float64
+	requests  int64
+	errors    int64
+	latencies []time.Duration
+}
+
+func newAdaptiveLimit(
+	ctx context.Context,
+	limiter *Limiter,
+	metrics *Metrics,
+	floor, ceiling, maxErrorRate float64,
+	maxLatency time.Duration,
+	percentile float64,
+	interval time.Duration,
+) *adaptiveLimit {
+	a := &adaptiveLimit{
+		limiter:      limiter,
+		metrics:      metrics,
+		floor:        floor,
+		ceiling:      ceiling,
+		maxErrorRate: maxErrorRate,
+		maxLatency:   maxLatency,
+		percentile:   percentile,
+		interval:     interval,
+		factor:       ceiling,
+		latencies:    make([]time.Duration, 0, adaptiveSamples),
+	}
+	metrics.Set("adaptive_factor", ceiling)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				a.adapt()
+			}
+		}
+	}()
+	return a
+}
+
+// record adds a response of the upstream to the current interval
+func (a *adaptiveLimit) record(status int, latency time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.requests++
+	if status >= 500 {
+		a.errors++
+	}
+	// reservoir sampling, to bound the memory used
+	if len(a.latencies) < adaptiveSamples {
+		a.latencies = append(a.latencies, latency)
+	} else if i := rand.Int63n(a.requests); i < adaptiveSamples {
+		a.latencies[i] = latency
+	}
+}
+
+// adapt sends the health of the upstream, seen by this instance during the
+// last interval, to Redis, and gets back the shared factor
+func (a *adaptiveLimit) adapt() {
+	a.mu.Lock()
+	requests, errors, latencies := a.requests, a.errors, a.latencies
+	a.requests, a.errors = 0, 0
+	a.latencies = make([]time.Duration, 0, adaptiveSamples)
+	a.mu.Unlock()
+
+	errorRate := 0.0
+	if requests >= adaptiveMinRequests {
+		errorRate = float64(errors) / float64(requests)
+	}
+	latency := percentile(latencies, a.percentile)
+	healthy := errorRate <= a.maxErrorRate && (a.maxLatency == 0 || latency <= a.maxLatency)
+
+	a.metrics.Set("adaptive_error_ratio", errorRate)
+	a.metrics.Set("adaptive_latency_seconds", latency.Seconds())
+
+	factor, err := a.limiter.Adapt(healthy, adaptiveIncrease, adaptiveDecrease, a.floor, a.ceiling, a.interval)
+	if err != nil {
+		// keep the current factor until Redis is back
+		return
+	}
+	a.mu.Lock()
+	a.factor = factor
+	a.mu.Unlock()
+	a.metrics.Set("adaptive_factor", factor)
+}
+
+// scale returns the limit scaled by the current factor
+func (a *adaptiveLimit) scale(limit Limit) Limit {
+	a.mu.Lock()
+	factor := a.factor
+	a.mu.Unlock()
+
+	limit.Rate = int64(math.Max(1, math.Round(float64(limit.Rate)*factor)))
+	return limit
+}
+
+// currentFactor returns the current factor
+func (a *adaptiveLimit) currentFactor() float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.factor
+}
+
+// percentile returns the p-th percentile (0 < p <= 100) of the latencies
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	i := int(math.Ceil(p/100*float64(len(latencies)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return latencies[i]
+}
@@ -0,0 +1,98 @@
+package traefik_cluster_ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPercentile(t *testing.T) {
+	latencies := make([]time.Duration, 0, 100)
+	for i := 100; i >= 1; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 95*time.Millisecond, percentile(latencies, 95))
+	assert.Equal(t, 100*time.Millisecond, percentile(latencies, 100))
+	assert.Equal(t, 1*time.Millisecond, percentile(latencies, 1))
+	assert.Equal(t, time.Duration(0), percentile(nil, 95))
+}
+
+func TestAdaptiveScale(t *testing.T) {
+	a := &adaptiveLimit{factor: 0.25}
+	limit := a.scale(Limit{Rate: 100, Burst: 10, Period: time.Second})
+	assert.Equal(t, int64(25), limit.Rate)
+	assert.Equal(t, int64(10), limit.Burst)
+
+	// never below 1
+	a.factor = 0.001
+	assert.Equal(t, int64(1), a.scale(Limit{Rate: 100, Burst: 10, Period: time.Second}).Rate)
+}
+
+func TestStatusResponseWriter(t *testing.T) {
+	w := &statusResponseWriter{ResponseWriter: httptest.NewRecorder()}
+	w.WriteHeader(http.StatusBadGateway)
+	w.Write([]byte("oops"))
+	assert.Equal(t, http.StatusBadGateway, w.status)
+
+	w = &statusResponseWriter{ResponseWriter: httptest.NewRecorder()}
+	w.Write([]byte("ok"))
+	assert.Equal(t, http.StatusOK, w.status)
+}
+
+func TestStatusResponseWriterHijack(t *testing.T) {
+	// the recorder cannot be hijacked
+	rec := httptest.NewRecorder()
+	w := &statusResponseWriter{ResponseWriter: rec}
+	_, _, err := w.Hijack()
+	assert.Error(t, err)
+	assert.Equal(t, rec, w.Unwrap())
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		w := &statusResponseWriter{ResponseWriter: rw}
+		conn, _, err := w.Hijack()
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+		assert.Equal(t, http.StatusSwitchingProtocols, w.status)
+	}))
+	defer server.Close()
+	_, err = http.Get(server.URL)
+	assert.Error(t, err)
+}
+
+func TestLimiterAdapt(t *testing.T) {
+	limiter, server := newTestLimiter(t, AlgorithmGCRA)
+	now := time.Now()
+	server.SetTime(now)
+	adapt := func(healthy bool, at time.Duration) float64 {
+		server.SetTime(now.Add(at))
+		factor, err := limiter.Adapt(healthy, 0.5, 0.5, 0.2, 1, 10*time.Second)
+		require.NoError(t, err)
+		return factor
+	}
+
+	// starts from the ceiling
+	assert.InDelta(t, 0.5, adapt(false, 0), 1e-9)
+	// at most one decrease per interval
+	assert.InDelta(t, 0.5, adapt(false, 5*time.Second), 1e-9)
+	assert.InDelta(t, 0.25, adapt(false, 10*time.Second), 1e-9)
+	// not below the floor
+	assert.InDelta(t, 0.2, adapt(false, 20*time.Second), 1e-9)
+
+	// no increase within an interval of the last decrease
+	assert.InDelta(t, 0.2, adapt(true, 25*time.Second), 1e-9)
+	assert.InDelta(t, 0.7, adapt(true, 30*time.Second), 1e-9)
+	// nor of the last increase
+	assert.InDelta(t, 0.7, adapt(true, 35*time.Second), 1e-9)
+	// not above the ceiling
+	assert.InDelta(t, 1, adapt(true, 40*time.Second), 1e-9)
+
+	// back to the ceiling when nobody reports anymore
+	assert.InDelta(t, 0.5, adapt(false, 50*time.Second), 1e-9)
+	server.FastForward(100 * time.Second)
+	assert.False(t, server.Exists("adaptive_test"))
+}
@@ -0,0 +1,106 @@
+package traefik_cluster_ratelimit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// bandwidth paces the responses to a per-source budget of bytes per second,
+// shared by all the instances: the bytes are leased from the Redis limiter
+// by chunks, before being written
+type bandwidth struct {
+	limiter *Limiter
+	// the limit, in bytes
+	limit Limit
+	chunk int
+}
+
+// wrap returns a ResponseWriter paced to the budget of the source, and a
+// function giving the unused bytes back, to call once the response is written
+func (b *bandwidth) wrap(rw http.ResponseWriter, req *http.Request, source string) (http.ResponseWriter, func()) {
+	w := &throttledResponseWriter{
+		ResponseWriter: rw,
+		ctx:            req.Context(),
+		bandwidth:      b,
+		key:            source,
+	}
+	return w, func() {
+		if w.paid && w.leased > 0 {
+			b.limiter.RefundBandwidth(w.key, b.limit, w.leased)
+		}
+	}
+}
+
+// throttledResponseWriter writes the response as the leased bytes allow
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	ctx       context.Context
+	bandwidth *bandwidth
+	key       string
+	// the bytes leased, and not written yet
+	leased int
+	// false if the lease was not charged, because of a Redis error
+	paid bool
+}
+
+// lease gets the next chunk of bytes, waiting for it if needed
+func (w *throttledResponseWriter) lease() error {
+	res, err := w.bandwidth.limiter.LeaseBandwidth(w.key, w.bandwidth.limit, w.bandwidth.chunk)
+	// on error, we let pass through
+	w.paid = err == nil
+	if err == nil && res.Delay > 0 {
+		if !sleep(w.ctx, res.Delay) {
+			// the client is gone
+			return w.ctx.Err()
+		}
+	}
+	w.leased = w.bandwidth.chunk
+	return nil
+}
+
+func (w *throttledResponseWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		if w.leased == 0 {
+			if err := w.lease(); err != nil {
+				return written, err
+			}
+		}
+		n := len(b)
+		if n > w.leased {
+			n = w.leased
+		}
+		n, err := w.ResponseWriter.Write(b[:n])
+		written += n
+		w.leased -= n
+		b = b[n:]
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Flush keeps the streamed responses working
+func (w *throttledResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack keeps the websockets working. The hijacked connections are not paced
+func (w *throttledResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T is not a http.Hijacker", w.ResponseWriter)
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap is used by http.ResponseController
+func (w *throttledResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
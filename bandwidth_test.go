@@ -0,0 +1,67 @@
+package traefik_cluster_ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottledResponseWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	b := &bandwidth{limit: Limit{Rate: 1024, Burst: 1024}, chunk: 256}
+	rw, release := b.wrap(rec, httptest.NewRequest("GET", "/", nil), "1.2.3.4")
+
+	// the leased bytes are written without calling the limiter
+	w := rw.(*throttledResponseWriter)
+	w.leased = 10
+	n, err := rw.Write([]byte("0123456789"))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, "0123456789", rec.Body.String())
+	release()
+
+	rw.(http.Flusher).Flush()
+	assert.True(t, rec.Flushed)
+
+	// the recorder cannot be hijacked
+	_, _, err = rw.(http.Hijacker).Hijack()
+	assert.Error(t, err)
+	assert.Equal(t, rec, w.Unwrap())
+}
+
+func TestBandwidthLease(t *testing.T) {
+	limiter, server := newTestLimiter(t, AlgorithmGCRA)
+	limit := Limit{Rate: 1000, Burst: 1000, Period: time.Second}
+	b := &bandwidth{limiter: limiter, limit: limit, chunk: 256}
+	remaining := func() int {
+		res, err := limiter.LeaseBandwidth("1.2.3.4", limit, 0)
+		require.NoError(t, err)
+		return res.Remaining
+	}
+
+	rec := httptest.NewRecorder()
+	rw, release := b.wrap(rec, httptest.NewRequest("GET", "/", nil), "1.2.3.4")
+
+	// larger than a chunk: 3 chunks are leased
+	n, err := rw.Write(make([]byte, 600))
+	require.NoError(t, err)
+	assert.Equal(t, 600, n)
+	assert.Equal(t, 600, rec.Body.Len())
+	assert.Equal(t, 168, rw.(*throttledResponseWriter).leased)
+	assert.Equal(t, 1000-3*256, remaining())
+
+	// the unused bytes are given back
+	release()
+	assert.Equal(t, 1000-600, remaining())
+
+	// apart from the request rate of the source, and cleared with it
+	assert.False(t, server.Exists("rate_test1.2.3.4"))
+	assert.True(t, server.Exists("bandwidth_test1.2.3.4"))
+	require.NoError(t, limiter.Reset(context.Background(), "1.2.3.4"))
+	assert.False(t, server.Exists("bandwidth_test1.2.3.4"))
+}
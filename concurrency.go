@@ -0,0 +1,40 @@
+package traefik_cluster_ratelimit
+
+import (
+	"time"
+)
+
+// acquireSlot takes one of the concurrency slots of the source, and keeps
+// renewing its lease until the returned release function is called. If the
+// slot cannot be taken because of a redis error, the request is let through.
+func (rl *ClusterRateLimit) acquireSlot(source string) (func(), bool) {
+	id := randomID()
+	acquired, _, err := rl.redis.Acquire(source, rl.maxConcurrent, rl.concurrencyLease, id)
+	if err != nil {
+		return func() {}, true
+	}
+	if !acquired {
+		return nil, false
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// renew well before the lease expires, so that long uploads
+		// or exports keep their slot
+		ticker := time.NewTicker(rl.concurrencyLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				rl.redis.Renew(source, rl.concurrencyLease, id)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		rl.redis.Release(source, id)
+	}, true
+}
@@ -0,0 +1,62 @@
+package traefik_cluster_ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquireSlot(t *testing.T) {
+	// no rate limit, only the concurrency
+	rl, _ := newTestMiddleware(t, &Config{MaxConcurrent: 2}, nil)
+
+	release1, acquired := rl.acquireSlot("source")
+	require.True(t, acquired)
+	release2, acquired := rl.acquireSlot("source")
+	require.True(t, acquired)
+	_, acquired = rl.acquireSlot("source")
+	assert.False(t, acquired)
+
+	// the other sources have their own slots
+	release3, acquired := rl.acquireSlot("other")
+	require.True(t, acquired)
+	release3()
+
+	release1()
+	release3, acquired = rl.acquireSlot("source")
+	require.True(t, acquired)
+	release2()
+	release3()
+}
+
+func TestConcurrencyServeHTTP(t *testing.T) {
+	entered := make(chan struct{})
+	leave := make(chan struct{})
+	rl, _ := newTestMiddleware(t, &Config{MaxConcurrent: 1}, func(rw http.ResponseWriter, req *http.Request) {
+		entered <- struct{}{}
+		<-leave
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rl.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+	<-entered
+
+	rw := httptest.NewRecorder()
+	rl.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("retry-after"))
+
+	// the slot is released once the first request is served
+	close(leave)
+	<-done
+	go func() { <-entered }()
+	rw = httptest.NewRecorder()
+	rl.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
@@ -0,0 +1,109 @@
+package traefik_cluster_ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CostRule gives the cost of the requests it matches. All the criteria set
+// must match; a rule without any criterion matches all the requests
+type CostRule struct {
+	// Method is the HTTP method of the request, like "POST"
+	Method string `json:"method,omitempty" yaml:"method,omitempty"`
+	// PathPrefix matches the requests whose path starts with it, like "/search"
+	PathPrefix string `json:"pathPrefix,omitempty" yaml:"pathPrefix,omitempty"`
+	// PathRegex matches the requests whose path matches this regular expression
+	PathRegex string `json:"pathRegex,omitempty" yaml:"pathRegex,omitempty"`
+	// HeaderName and HeaderValue match the requests having this header value.
+	// Without HeaderValue, the header only needs to be present
+	HeaderName  string `json:"headerName,omitempty" yaml:"headerName,omitempty"`
+	HeaderValue string `json:"headerValue,omitempty" yaml:"headerValue,omitempty"`
+	// Cost is the number of requests the matching requests count for
+	Cost int64 `json:"cost" yaml:"cost"`
+}
+
+type costRule struct {
+	CostRule
+	pathRegex *regexp.Regexp
+}
+
+func (r *costRule) match(req *http.Request) bool {
+	if r.Method != "" && !strings.EqualFold(r.Method, req.Method) {
+		return false
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+		return false
+	}
+	if r.pathRegex != nil && !r.pathRegex.MatchString(req.URL.Path) {
+		return false
+	}
+	if r.HeaderName != "" {
+		values, ok := req.Header[http.CanonicalHeaderKey(r.HeaderName)]
+		if !ok || r.HeaderValue != "" && values[0] != r.HeaderValue {
+			return false
+		}
+	}
+	return true
+}
+
+// costResolver gives the cost of a request, from a trusted request header
+// or from the first matching rule
+type costResolver struct {
+	rules  []costRule
+	header string
+	// the header costs are clamped to it. 0 means no maximum
+	max int64
+}
+
+// newCostResolver validates the rules. maxCost is the smallest burst of the
+// limits, as a request costing more would never be allowed
+func newCostResolver(rules []CostRule, header string, maxCost int64) (*costResolver, error) {
+	c := &costResolver{
+		rules:  make([]costRule, 0, len(rules)),
+		header: header,
+		max:    maxCost,
+	}
+	for i, rule := range rules {
+		if rule.Cost < 1 {
+			return nil, fmt.Errorf("costRules[%d]: cost must be >=1", i)
+		}
+		if maxCost > 0 && rule.Cost > maxCost {
+			return nil, fmt.Errorf("costRules[%d]: cost must be <= burst (%d)", i, maxCost)
+		}
+		r := costRule{CostRule: rule}
+		if rule.PathRegex != "" {
+			pathRegex, err := regexp.Compile(rule.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("costRules[%d]: invalid pathRegex: %v", i, err)
+			}
+			r.pathRegex = pathRegex
+		}
+		c.rules = append(c.rules, r)
+	}
+	return c, nil
+}
+
+// cost returns the cost of the request, defaulting to the amount returned by
+// the source extractor
+func (c *costResolver) cost(req *http.Request, amount int64) int64 {
+	if c.header != "" {
+		if cost, err := strconv.ParseInt(req.Header.Get(c.header), 10, 64); err == nil && cost >= 1 {
+			if c.max > 0 && cost > c.max {
+				return c.max
+			}
+			return cost
+		}
+	}
+	for i := range c.rules {
+		if c.rules[i].match(req) {
+			return c.rules[i].Cost
+		}
+	}
+	if amount < 1 {
+		return 1
+	}
+	return amount
+}
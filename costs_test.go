@@ -0,0 +1,50 @@
+package traefik_cluster_ratelimit
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCostResolver(t *testing.T) {
+	costs, err := newCostResolver([]CostRule{
+		{Method: "POST", PathPrefix: "/search", Cost: 5},
+		{PathRegex: `^/export/[0-9]+$`, Cost: 20},
+		{HeaderName: "X-Plan", HeaderValue: "batch", Cost: 3},
+	}, "X-Cost", 50)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/search?q=x", nil)
+	assert.Equal(t, int64(5), costs.cost(req, 1))
+
+	req = httptest.NewRequest("GET", "/search", nil)
+	assert.Equal(t, int64(1), costs.cost(req, 1))
+
+	req = httptest.NewRequest("GET", "/export/42", nil)
+	assert.Equal(t, int64(20), costs.cost(req, 1))
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Plan", "batch")
+	assert.Equal(t, int64(3), costs.cost(req, 1))
+
+	// the trusted header wins, unless it is invalid
+	req = httptest.NewRequest("POST", "/search", nil)
+	req.Header.Set("X-Cost", "12")
+	assert.Equal(t, int64(12), costs.cost(req, 1))
+	req.Header.Set("X-Cost", "a lot")
+	assert.Equal(t, int64(5), costs.cost(req, 1))
+	// capped to the burst
+	req.Header.Set("X-Cost", "1000")
+	assert.Equal(t, int64(50), costs.cost(req, 1))
+
+	_, err = newCostResolver([]CostRule{{PathRegex: "(", Cost: 1}}, "", 0)
+	assert.Error(t, err)
+	_, err = newCostResolver([]CostRule{{Method: "GET"}}, "", 0)
+	assert.Error(t, err)
+	_, err = newCostResolver([]CostRule{{Method: "GET", Cost: 51}}, "", 50)
+	assert.Error(t, err)
+	_, err = newCostResolver([]CostRule{{Method: "GET", Cost: 51}}, "", 0)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,128 @@
+package traefik_cluster_ratelimit
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+type denyEntry struct {
+	key string
+	// n is the smallest cost denied: requests costing less may still be allowed
+	n       int
+	retryAt time.Time
+	resetAt time.Time
+	limit   Limit
+}
+
+// DenyCacheLimiter wraps a RateLimiter with a bounded local cache of the
+// denied keys: until RetryAfter expires, the requests from a denied key are
+// rejected without calling the backend. When full, the least recently used
+// denial is evicted.
+type DenyCacheLimiter struct {
+	limiter RateLimiter
+	size    int
+	metrics *Metrics
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// the entries, from the most recently used to the least recently used one
+	lru *list.List
+}
+
+// NewDenyCacheLimiter returns a new DenyCacheLimiter, keeping at most size denied keys.
+func NewDenyCacheLimiter(limiter RateLimiter, size int, metrics *Metrics) *DenyCacheLimiter {
+	return &DenyCacheLimiter{
+		limiter: limiter,
+		size:    size,
+		metrics: metrics,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// AllowN reports whether n events may happen at time now.
+func (l *DenyCacheLimiter) AllowN(key string, limit Limit, n int) (*Result, error) {
+	if res := l.cached(key, limit, n); res != nil {
+		l.metrics.Add("deny_cache_hits_total", 1)
+		return res, nil
+	}
+
+	res, err := l.limiter.AllowN(key, limit, n)
+	if err != nil {
+		return nil, err
+	}
+	if res.Allowed == 0 && res.RetryAfter > 0 {
+		l.store(key, limit, n, res)
+	}
+	return res, nil
+}
+
+// cached returns the denial of the key, if any
+func (l *DenyCacheLimiter) cached(key string, limit Limit, n int) *Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	elem, ok := l.entries[key]
+	if !ok {
+		return nil
+	}
+	e := elem.Value.(*denyEntry)
+	now := time.Now()
+	if !now.Before(e.retryAt) {
+		l.remove(elem)
+		return nil
+	}
+	if n < e.n || e.limit != limit {
+		return nil
+	}
+	l.lru.MoveToFront(elem)
+	return &Result{
+		Limit:      limit,
+		Allowed:    0,
+		Remaining:  0,
+		RetryAfter: e.retryAt.Sub(now),
+		ResetAfter: e.resetAt.Sub(now),
+	}
+}
+
+func (l *DenyCacheLimiter) store(key string, limit Limit, n int, res *Result) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	e := &denyEntry{
+		key:     key,
+		n:       n,
+		retryAt: now.Add(res.RetryAfter),
+		resetAt: now.Add(res.ResetAfter),
+		limit:   limit,
+	}
+	if elem, ok := l.entries[key]; ok {
+		elem.Value = e
+		l.lru.MoveToFront(elem)
+		return
+	}
+	if len(l.entries) >= l.size {
+		l.remove(l.lru.Back())
+	}
+	l.entries[key] = l.lru.PushFront(e)
+}
+
+// remove removes an entry (l.mu must be held)
+func (l *DenyCacheLimiter) remove(elem *list.Element) {
+	l.lru.Remove(elem)
+	delete(l.entries, elem.Value.(*denyEntry).key)
+}
+
+// Reset gets a key and reset all limitations and previous usages
+func (l *DenyCacheLimiter) Reset(ctx context.Context, key string) error {
+	l.mu.Lock()
+	if elem, ok := l.entries[key]; ok {
+		l.remove(elem)
+	}
+	l.mu.Unlock()
+
+	return l.limiter.Reset(ctx, key)
+}
@@ -0,0 +1,56 @@
+package traefik_cluster_ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDenyCacheLimiter(t *testing.T) {
+	metrics := &Metrics{counters: map[string]int64{}, gauges: map[string]float64{}}
+	backend := NewLocalLimiter()
+	limiter := NewDenyCacheLimiter(backend, 2, metrics)
+	limit := Limit{Rate: 1, Burst: 1, Period: time.Minute}
+
+	res, err := limiter.AllowN("1.2.3.4", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Allowed)
+
+	res, err = limiter.AllowN("1.2.3.4", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Allowed)
+	assert.Equal(t, int64(0), metrics.Counter("deny_cache_hits_total"))
+
+	// the denial is now cached
+	res, err = limiter.AllowN("1.2.3.4", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Allowed)
+	assert.Greater(t, res.RetryAfter, 50*time.Second)
+	assert.Equal(t, int64(1), metrics.Counter("deny_cache_hits_total"))
+
+	// the cache is bounded
+	for _, key := range []string{"a", "b", "c"} {
+		limiter.AllowN(key, limit, 1)
+		limiter.AllowN(key, limit, 1)
+	}
+	assert.LessOrEqual(t, len(limiter.entries), 2)
+	assert.Equal(t, len(limiter.entries), limiter.lru.Len())
+
+	// the least recently used denial is evicted first
+	limiter.AllowN("b", limit, 1)
+	limiter.AllowN("d", limit, 1)
+	limiter.AllowN("d", limit, 1)
+	assert.Contains(t, limiter.entries, "b")
+	assert.Contains(t, limiter.entries, "d")
+	assert.NotContains(t, limiter.entries, "c")
+
+	// reset clears the cached denial
+	limiter.AllowN("1.2.3.4", limit, 1)
+	require.NoError(t, limiter.Reset(context.Background(), "1.2.3.4"))
+	res, err = limiter.AllowN("1.2.3.4", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Allowed)
+}
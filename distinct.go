@@ -0,0 +1,106 @@
+package traefik_cluster_ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nzin/traefik-cluster-ratelimit/internal/utils"
+)
+
+// DistinctLimitConfig is one of Config.DistinctLimits: it limits the number of
+// distinct values (like IPs or usernames) used by a source (like an API key)
+// per period
+type DistinctLimitConfig struct {
+	// Name identifies the limit, in the X-RateLimit-Policy header of the rejections
+	Name string `json:"name" yaml:"name"`
+	// SourceCriterion defines how the requests are grouped (the client IP by default)
+	SourceCriterion *utils.SourceCriterion `json:"sourceCriterion,omitempty" yaml:"sourceCriterion,omitempty"`
+	// ValueCriterion defines the value whose distinct occurrences are counted (the client
+	// IP by default)
+	ValueCriterion *utils.SourceCriterion `json:"valueCriterion,omitempty" yaml:"valueCriterion,omitempty"`
+	// Max is the maximum number of distinct values per period
+	Max int64 `json:"max" yaml:"max"`
+	// Period, in seconds, defaults to an hour. The periods are aligned on the unix epoch
+	Period int64 `json:"period,omitempty" yaml:"period,omitempty"`
+}
+
+type distinctLimit struct {
+	name          string
+	sourceMatcher utils.SourceExtractor
+	valueMatcher  utils.SourceExtractor
+	max           int64
+	period        int64
+}
+
+// newDistinctLimits validates the configured list of distinct-value limits
+func newDistinctLimits(configs []DistinctLimitConfig) ([]distinctLimit, error) {
+	limits := make([]distinctLimit, 0, len(configs))
+	names := map[string]bool{}
+	for i, config := range configs {
+		if config.Name == "" {
+			return nil, fmt.Errorf("distinctLimits[%d]: name is mandatory", i)
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("distinctLimits[%d]: duplicated name %q", i, config.Name)
+		}
+		names[config.Name] = true
+
+		if config.Max < 1 {
+			return nil, fmt.Errorf("distinct limit %s: max must be >=1", config.Name)
+		}
+		if config.Period < 1 {
+			config.Period = 3600
+		}
+		sourceMatcher, err := utils.GetSourceExtractor(config.SourceCriterion)
+		if err != nil {
+			return nil, fmt.Errorf("distinct limit %s: %v", config.Name, err)
+		}
+		valueMatcher, err := utils.GetSourceExtractor(config.ValueCriterion)
+		if err != nil {
+			return nil, fmt.Errorf("distinct limit %s: %v", config.Name, err)
+		}
+		limits = append(limits, distinctLimit{
+			name:          config.Name,
+			sourceMatcher: sourceMatcher,
+			valueMatcher:  valueMatcher,
+			max:           config.Max,
+			period:        config.Period,
+		})
+	}
+	return limits, nil
+}
+
+// bounds returns the period containing now
+func (d *distinctLimit) bounds(now time.Time) (time.Time, time.Time) {
+	start := now.Unix() - now.Unix()%d.period
+	return time.Unix(start, 0), time.Unix(start+d.period, 0)
+}
+
+// allowDistinct checks the distinct-value limits, in order. It returns the
+// result and the name of the first limit rejecting the request, or nil if
+// none did
+func (rl *ClusterRateLimit) allowDistinct(req *http.Request) (*Result, string) {
+	for i := range rl.distinctLimits {
+		d := &rl.distinctLimits[i]
+		source, _, err := d.sourceMatcher.Extract(req)
+		if err != nil || source == "" {
+			continue
+		}
+		value, _, err := d.valueMatcher.Extract(req)
+		if err != nil || value == "" {
+			continue
+		}
+		start, end := d.bounds(time.Now())
+		res, err := rl.redis.AllowDistinct(fmt.Sprintf("%s:%s:%d", d.name, source, start.Unix()), value, Limit{
+			Rate:   d.max,
+			Burst:  d.max,
+			Period: end.Sub(start),
+		}, end)
+		// on error, we let pass through
+		if err == nil && res.Allowed <= 0 {
+			return res, d.name
+		}
+	}
+	return nil, ""
+}
@@ -0,0 +1,99 @@
+package traefik_cluster_ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nzin/traefik-cluster-ratelimit/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDistinctLimits(t *testing.T) {
+	_, err := newDistinctLimits([]DistinctLimitConfig{{Name: "ips", Max: 0}})
+	assert.Error(t, err)
+	_, err = newDistinctLimits([]DistinctLimitConfig{{Name: "ips", Max: 1}, {Name: "ips", Max: 2}})
+	assert.Error(t, err)
+
+	limits, err := newDistinctLimits([]DistinctLimitConfig{{
+		Name:            "ips-per-key",
+		SourceCriterion: &utils.SourceCriterion{RequestHeaderName: "X-Api-Key"},
+		Max:             20,
+	}})
+	require.NoError(t, err)
+	require.Len(t, limits, 1)
+	assert.Equal(t, int64(3600), limits[0].period)
+
+	start, end := limits[0].bounds(time.Unix(1790001234, 0))
+	assert.Equal(t, time.Unix(1789999200, 0), start)
+	assert.Equal(t, time.Unix(1790002800, 0), end)
+}
+
+func TestLimiterAllowDistinct(t *testing.T) {
+	limiter, server := newTestLimiter(t, AlgorithmGCRA)
+	limit := Limit{Rate: 3, Burst: 3, Period: time.Hour}
+	end := time.Now().Add(time.Hour)
+
+	allow := func(value string) *Result {
+		res, err := limiter.AllowDistinct("key", value, limit, end)
+		require.NoError(t, err)
+		return res
+	}
+
+	for i, value := range []string{"a", "b", "c"} {
+		res := allow(value)
+		assert.Equal(t, 1, res.Allowed, value)
+		assert.Equal(t, 2-i, res.Remaining, value)
+	}
+	// a new value is rejected at the cap...
+	res := allow("d")
+	assert.Equal(t, 0, res.Allowed)
+	assert.InDelta(t, time.Hour, res.ResetAfter, float64(time.Second))
+	// ... while the known ones are still allowed
+	assert.Equal(t, 1, allow("a").Allowed)
+	assert.Equal(t, 1, allow("c").Allowed)
+
+	// the rejected values were not counted
+	assert.Equal(t, 0, allow("d").Allowed)
+	assert.Equal(t, 0, allow("e").Allowed)
+	count, err := server.PfCount("distinct_testkey")
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.False(t, server.Exists("distinct_testkey:scratch"))
+
+	// the other keys have their own values
+	res, err = limiter.AllowDistinct("other", "d", limit, end)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Allowed)
+}
+
+func TestAllowDistinct(t *testing.T) {
+	rl, _ := newTestMiddleware(t, &Config{
+		DistinctLimits: []DistinctLimitConfig{{
+			Name:           "users-per-ip",
+			ValueCriterion: &utils.SourceCriterion{RequestHeaderName: "X-User"},
+			Max:            2,
+		}},
+	}, func(rw http.ResponseWriter, req *http.Request) {})
+
+	serve := func(user string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "1.2.3.4:1234"
+		req.Header.Set("X-User", user)
+		rl.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, http.StatusOK, serve("alice").Code)
+	assert.Equal(t, http.StatusOK, serve("bob").Code)
+	rw := serve("carol")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "users-per-ip", rw.Header().Get("X-RateLimit-Policy"))
+	assert.NotEmpty(t, rw.Header().Get("retry-after"))
+	assert.Equal(t, http.StatusOK, serve("alice").Code)
+	// without the value, the limit does not apply
+	assert.Equal(t, http.StatusOK, serve("").Code)
+}
@@ -0,0 +1,33 @@
+package traefik_cluster_ratelimit
+
+import (
+	"context"
+	"net/http"
+)
+
+// failures only charges the requests failing upstream (like the failed logins),
+// so that the legitimate clients are never limited. The cost of a request is
+// consumed before it is let through, so that parallel guesses cannot bypass
+// the limit, and given back once the upstream answered with another status
+type failures struct {
+	limiter  *Limiter
+	statuses statusRanges
+	// the statuses clearing the failures of the source, if any
+	resets statusRanges
+}
+
+// record refunds the charged cost of a request that did not fail, or clears
+// the failures of the source on a reset status
+func (f *failures) record(source string, limit Limit, charged int, status int) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	switch {
+	case f.statuses.contains(status):
+		// stays charged
+	case f.resets.contains(status):
+		f.limiter.Reset(context.Background(), source)
+	case charged > 0:
+		f.limiter.RefundN(source, limit, charged)
+	}
+}
@@ -0,0 +1,75 @@
+package traefik_cluster_ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailures(t *testing.T) {
+	entered := make(chan struct{}, 10)
+	leave := make(chan struct{})
+	rl, _ := newTestMiddleware(t, &Config{
+		Average:            2,
+		Burst:              2,
+		Period:             900,
+		FailureStatus:      []string{"401"},
+		FailureResetStatus: []string{"200"},
+	}, func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Wait") != "" {
+			entered <- struct{}{}
+			<-leave
+		}
+		status, _ := strconv.Atoi(req.Header.Get("X-Status"))
+		rw.WriteHeader(status)
+	})
+
+	serve := func(ip string, status int, wait bool) int {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set("X-Status", strconv.Itoa(status))
+		if wait {
+			req.Header.Set("X-Wait", "1")
+		}
+		rl.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	t.Run("charge on the failures", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, serve("1.1.1.1", http.StatusUnauthorized, false))
+		assert.Equal(t, http.StatusUnauthorized, serve("1.1.1.1", http.StatusUnauthorized, false))
+		assert.Equal(t, http.StatusTooManyRequests, serve("1.1.1.1", http.StatusOK, false))
+	})
+
+	t.Run("no charge on the other statuses", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, http.StatusFound, serve("2.2.2.2", http.StatusFound, false), i)
+		}
+	})
+
+	t.Run("reset on success", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, serve("3.3.3.3", http.StatusUnauthorized, false))
+		assert.Equal(t, http.StatusOK, serve("3.3.3.3", http.StatusOK, false))
+		assert.Equal(t, http.StatusUnauthorized, serve("3.3.3.3", http.StatusUnauthorized, false))
+		assert.Equal(t, http.StatusUnauthorized, serve("3.3.3.3", http.StatusUnauthorized, false))
+		assert.Equal(t, http.StatusTooManyRequests, serve("3.3.3.3", http.StatusUnauthorized, false))
+	})
+
+	t.Run("parallel guesses", func(t *testing.T) {
+		codes := make(chan int, 2)
+		for i := 0; i < 2; i++ {
+			go func() { codes <- serve("4.4.4.4", http.StatusUnauthorized, true) }()
+		}
+		<-entered
+		<-entered
+		// the requests in flight already consumed the burst
+		assert.Equal(t, http.StatusTooManyRequests, serve("4.4.4.4", http.StatusUnauthorized, false))
+		close(leave)
+		assert.Equal(t, http.StatusUnauthorized, <-codes)
+		assert.Equal(t, http.StatusUnauthorized, <-codes)
+	})
+}
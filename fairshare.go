@@ -0,0 +1,105 @@
+package traefik_cluster_ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// the sources seen by this instance are sent to Redis every second
+	fairShareInterval = time.Second
+	// the maximum number of sources seen by this instance per interval. The
+	// other ones are not counted
+	fairShareMaxSeen = 100000
+)
+
+// fairShare splits the limit (the capacity of the upstream) between the
+// sources active across all the instances, tracked in Redis
+type fairShare struct {
+	limiter *Limiter
+	metrics *Metrics
+	min     int64
+	max     int64
+	window  time.Duration
+
+	mu     sync.Mutex
+	active int64
+	// the sources seen since the last interval
+	seen map[string]struct{}
+}
+
+func newFairShare(ctx context.Context, limiter *Limiter, metrics *Metrics, min, max int64, window time.Duration) *fairShare {
+	f := &fairShare{
+		limiter: limiter,
+		metrics: metrics,
+		min:     min,
+		max:     max,
+		window:  window,
+		seen:    map[string]struct{}{},
+	}
+
+	go func() {
+		ticker := time.NewTicker(fairShareInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				f.sync()
+			}
+		}
+	}()
+	return f
+}
+
+// sync sends the sources seen during the last interval to Redis, and gets
+// back the number of active sources
+func (f *fairShare) sync() {
+	f.mu.Lock()
+	seen := f.seen
+	f.seen = map[string]struct{}{}
+	f.mu.Unlock()
+
+	sources := make([]string, 0, len(seen))
+	for source := range seen {
+		sources = append(sources, source)
+	}
+	active, err := f.limiter.ActiveSources(sources, f.window)
+	if err != nil {
+		// keep the current number until Redis is back
+		return
+	}
+	f.mu.Lock()
+	f.active = active
+	f.mu.Unlock()
+	f.metrics.Set("fair_share_active_sources", float64(active))
+}
+
+// share returns the share of the limit of a source, and marks it as active
+func (f *fairShare) share(source string, limit Limit) Limit {
+	f.mu.Lock()
+	if len(f.seen) < fairShareMaxSeen {
+		f.seen[source] = struct{}{}
+	}
+	active := f.active
+	f.mu.Unlock()
+
+	// the source may not be counted yet
+	if active < 1 {
+		active = 1
+	}
+	rate := limit.Rate / active
+	if rate < f.min {
+		rate = f.min
+	}
+	if rate > f.max {
+		rate = f.max
+	}
+	// the burst is scaled as the rate
+	limit.Burst = int64(math.Max(1, math.Round(float64(limit.Burst)*float64(rate)/float64(limit.Rate))))
+	limit.Rate = rate
+	return limit
+}
@@ -0,0 +1,52 @@
+package traefik_cluster_ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFairShare(t *testing.T) {
+	f := &fairShare{min: 10, max: 1000, window: 10 * time.Second, seen: map[string]struct{}{}}
+	limit := Limit{Rate: 2000, Burst: 400, Period: time.Second}
+
+	// a single client gets up to the maximum
+	assert.Equal(t, Limit{Rate: 1000, Burst: 200, Period: time.Second}, f.share("1.2.3.4", limit))
+	assert.Contains(t, f.seen, "1.2.3.4")
+
+	f.active = 4
+	assert.Equal(t, Limit{Rate: 500, Burst: 100, Period: time.Second}, f.share("1.2.3.4", limit))
+
+	// but never less than the minimum
+	f.active = 1000
+	assert.Equal(t, Limit{Rate: 10, Burst: 2, Period: time.Second}, f.share("1.2.3.4", limit))
+}
+
+func TestLimiterActiveSources(t *testing.T) {
+	limiter, server := newTestLimiter(t, AlgorithmGCRA)
+	now := time.Now()
+	active := func(at time.Duration, sources ...string) int64 {
+		server.SetTime(now.Add(at))
+		count, err := limiter.ActiveSources(sources, 10*time.Second)
+		require.NoError(t, err)
+		return count
+	}
+
+	assert.Equal(t, int64(2), active(0, "1.1.1.1", "2.2.2.2"))
+	assert.Equal(t, int64(3), active(5*time.Second, "1.1.1.1", "3.3.3.3"))
+	// seen by another instance
+	assert.Equal(t, int64(3), active(5*time.Second))
+
+	// 2.2.2.2 was not seen during the last window
+	assert.Equal(t, int64(2), active(12*time.Second))
+	assert.Equal(t, int64(0), active(16*time.Second))
+
+	// the set expires once nobody reports anymore
+	assert.Equal(t, int64(1), active(20*time.Second, "1.1.1.1"))
+	server.FastForward(19 * time.Second)
+	assert.True(t, server.Exists("active_test"))
+	server.FastForward(time.Second)
+	assert.False(t, server.Exists("active_test"))
+}
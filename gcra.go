@@ -0,0 +1,56 @@
+package traefik_cluster_ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// jan1st2024 is the epoch used to store theoretical arrival times, the same
+// one as in allowNLua, to keep the floating point values small
+const jan1st2024 = 1704085200
+
+// gcraNow returns the current time, in seconds since jan1st2024
+func gcraNow() float64 {
+	now := time.Now()
+	return float64(now.Unix()-jan1st2024) + float64(now.Nanosecond())/1e9
+}
+
+// gcra is the Go counterpart of allowNLua, for the backends that cannot run
+// a Lua script. tat is the stored theoretical arrival time (or now if there is
+// none). It returns the new tat to store, which is 0 when nothing has to be
+// stored (the request was denied, or nothing was consumed).
+func gcra(tat, now float64, limit Limit, n int) (float64, *Result) {
+	emissionInterval := limit.Period.Seconds() / float64(limit.Rate)
+	increment := emissionInterval * float64(n)
+	burstOffset := emissionInterval * float64(limit.Burst)
+
+	tat = math.Max(tat, now)
+
+	newTat := tat + increment
+	allowAt := newTat - burstOffset
+
+	diff := now - allowAt
+	remaining := diff / emissionInterval
+
+	if remaining < 0 {
+		return 0, &Result{
+			Limit:      limit,
+			Allowed:    0,
+			Remaining:  0,
+			RetryAfter: dur(-diff),
+			ResetAfter: dur(tat - now),
+		}
+	}
+
+	resetAfter := newTat - now
+	if resetAfter <= 0 {
+		newTat = 0
+	}
+	return newTat, &Result{
+		Limit:      limit,
+		Allowed:    n,
+		Remaining:  int(remaining),
+		RetryAfter: -1,
+		ResetAfter: dur(resetAfter),
+	}
+}
@@ -2,10 +2,14 @@ module github.com/nzin/traefik-cluster-ratelimit
 
 go 1.19
 
-require github.com/stretchr/testify v1.9.0
+require (
+	github.com/alicebob/miniredis/v2 v2.39.0
+	github.com/stretchr/testify v1.9.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,53 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned while the breaker refuses to call the backend
+var ErrOpen = errors.New("breaker opened")
+
+// Breaker stops talking to a backend after a number of consecutive failures,
+// and tries again once the reattempt period is over
+type Breaker struct {
+	mu               sync.Mutex
+	errorCount       int64
+	nextAttempt      time.Time
+	breakerThreshold int64
+	reattemptPeriod  int64
+}
+
+func NewBreaker(breakerThreshold int64, reattemptPeriod int64) *Breaker {
+	return &Breaker{
+		errorCount:       0,
+		nextAttempt:      time.Now(),
+		breakerThreshold: breakerThreshold,
+		reattemptPeriod:  reattemptPeriod,
+	}
+}
+
+// Run calls fn, unless the breaker is opened
+func (b *Breaker) Run(fn func() (interface{}, error)) (interface{}, error) {
+	b.mu.Lock()
+	opened := b.errorCount >= b.breakerThreshold && !time.Now().After(b.nextAttempt)
+	b.mu.Unlock()
+	if opened {
+		return nil, ErrOpen
+	}
+
+	res, err := fn()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.errorCount++
+		if b.errorCount >= b.breakerThreshold {
+			b.nextAttempt = time.Now().Add(time.Duration(b.reattemptPeriod) * time.Second)
+		}
+	} else {
+		b.errorCount = 0
+	}
+	return res, err
+}
@@ -0,0 +1,337 @@
+package memcached
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minimum memcached connection pool size
+const MAX_ACTIVE = 5
+
+var (
+	// ErrCacheMiss means that a Gets failed because the item wasn't present
+	ErrCacheMiss = errors.New("memcached: cache miss")
+	// ErrNotStored means that an Add or a CompareAndSwap failed because the
+	// condition was not satisfied (item already present, or item gone)
+	ErrNotStored = errors.New("memcached: item not stored")
+	// ErrCASConflict means that a CompareAndSwap failed because the item was
+	// modified since it was read
+	ErrCASConflict = errors.New("memcached: compare-and-swap conflict")
+	// ErrClosed means that the client was closed
+	ErrClosed = errors.New("memcached: client closed")
+)
+
+// MaxExpiration is the longest TTL memcached accepts, in seconds: above it,
+// the expiration is read as a unix timestamp
+const MaxExpiration = 30 * 24 * 3600
+
+// Item is a memcached entry
+type Item struct {
+	Key   string
+	Value []byte
+	// Expiration is the TTL of the item in seconds (0 means no expiration)
+	Expiration int32
+	// casID is the "cas unique" value returned by Gets
+	casID uint64
+}
+
+type Client interface {
+	Close()
+	Ping() error
+	Gets(key string) (*Item, error)
+	Add(item *Item) error
+	CompareAndSwap(item *Item) error
+	Delete(key string) error
+}
+
+type conn struct {
+	nc net.Conn
+	rw *bufio.ReadWriter
+}
+
+type ClientImpl struct {
+	mu                sync.Mutex
+	closed            bool
+	conns             chan *conn
+	addr              string
+	maxActive         int
+	dialTimeout       time.Duration
+	connectionTimeout time.Duration
+}
+
+// NewClient initializes a new memcached client with connection pool
+func NewClient(addr string, connectionTimeout time.Duration) (Client, error) {
+	maxActive := MAX_ACTIVE
+
+	if maxActive <= 0 {
+		return nil, errors.New("maxActive must be greater than 0")
+	}
+
+	c := &ClientImpl{
+		conns:             make(chan *conn, maxActive),
+		addr:              addr,
+		maxActive:         maxActive,
+		dialTimeout:       connectionTimeout * 2,
+		connectionTimeout: connectionTimeout,
+	}
+
+	// Prepopulate the pool with connections
+	for i := 0; i < maxActive; i++ {
+		cn, err := c.newConn()
+		if err == nil {
+			c.conns <- cn
+		}
+	}
+
+	return c, nil
+}
+
+func (c *ClientImpl) newConn() (*conn, error) {
+	nc, err := net.DialTimeout("tcp", c.addr, c.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{
+		nc: nc,
+		rw: bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)),
+	}, nil
+}
+
+// get retrieves a connection from the pool
+func (c *ClientImpl) get() (*conn, error) {
+	select {
+	case cn, ok := <-c.conns:
+		if !ok {
+			return nil, ErrClosed
+		}
+		return cn, nil
+	default:
+		return c.newConn()
+	}
+}
+
+// put returns a connection back to the pool
+func (c *ClientImpl) put(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// If the pool is closed or full, just close the connection
+	if c.closed || len(c.conns) >= c.maxActive {
+		cn.nc.Close()
+		return
+	}
+
+	c.conns <- cn
+}
+
+// Close closes all the connections in the pool
+func (c *ClientImpl) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.conns)
+	for cn := range c.conns {
+		cn.nc.Close()
+	}
+}
+
+// do runs fn on a pooled connection. The connection is dropped (instead of
+// being returned to the pool) on network or protocol errors, because we
+// don't know what is left to read on it
+func (c *ClientImpl) do(fn func(cn *conn) error) error {
+	cn, err := c.get()
+	if err != nil {
+		return err
+	}
+
+	err = cn.nc.SetDeadline(time.Now().Add(c.connectionTimeout))
+	if err != nil {
+		cn.nc.Close()
+		return fmt.Errorf("error setting deadline: %w", err)
+	}
+
+	err = fn(cn)
+	if err != nil && !isResumableError(err) {
+		cn.nc.Close()
+		return err
+	}
+	c.put(cn)
+	return err
+}
+
+func isResumableError(err error) bool {
+	return err == ErrCacheMiss || err == ErrNotStored || err == ErrCASConflict
+}
+
+// readLine reads a response line, without the trailing "\r\n"
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("error reading response: %w", err)
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+// checkError converts a memcached error line into an error
+func checkError(line string) error {
+	switch {
+	case line == "ERROR":
+		return errors.New("memcached: unknown command")
+	case strings.HasPrefix(line, "CLIENT_ERROR "):
+		return fmt.Errorf("memcached: client error: %s", line[len("CLIENT_ERROR "):])
+	case strings.HasPrefix(line, "SERVER_ERROR "):
+		return fmt.Errorf("memcached: server error: %s", line[len("SERVER_ERROR "):])
+	}
+	return nil
+}
+
+func (c *ClientImpl) Ping() error {
+	return c.do(func(cn *conn) error {
+		if _, err := cn.rw.WriteString("version\r\n"); err != nil {
+			return fmt.Errorf("error sending command: %w", err)
+		}
+		if err := cn.rw.Flush(); err != nil {
+			return fmt.Errorf("error sending command: %w", err)
+		}
+		line, err := readLine(cn.rw.Reader)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, "VERSION ") {
+			return fmt.Errorf("version result error: %s", line)
+		}
+		return nil
+	})
+}
+
+// Gets fetches an item with its "cas unique" value, to be used later with
+// CompareAndSwap
+func (c *ClientImpl) Gets(key string) (*Item, error) {
+	var item *Item
+	err := c.do(func(cn *conn) error {
+		if _, err := fmt.Fprintf(cn.rw, "gets %s\r\n", key); err != nil {
+			return fmt.Errorf("error sending command: %w", err)
+		}
+		if err := cn.rw.Flush(); err != nil {
+			return fmt.Errorf("error sending command: %w", err)
+		}
+
+		for {
+			line, err := readLine(cn.rw.Reader)
+			if err != nil {
+				return err
+			}
+			if line == "END" {
+				break
+			}
+			if err := checkError(line); err != nil {
+				return err
+			}
+
+			// VALUE <key> <flags> <bytes> <cas unique>
+			fields := strings.Fields(line)
+			if len(fields) != 5 || fields[0] != "VALUE" {
+				return fmt.Errorf("unexpected gets result: %s", line)
+			}
+			size, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return fmt.Errorf("unexpected gets result: %s", line)
+			}
+			casID, err := strconv.ParseUint(fields[4], 10, 64)
+			if err != nil {
+				return fmt.Errorf("unexpected gets result: %s", line)
+			}
+
+			// data block followed by "\r\n"
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(cn.rw.Reader, data); err != nil {
+				return fmt.Errorf("error reading response: %w", err)
+			}
+			item = &Item{
+				Key:   fields[1],
+				Value: data[:size],
+				casID: casID,
+			}
+		}
+
+		if item == nil {
+			return ErrCacheMiss
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// Add stores an item only if it doesn't exist yet
+func (c *ClientImpl) Add(item *Item) error {
+	return c.store(fmt.Sprintf("add %s 0 %d %d", item.Key, item.Expiration, len(item.Value)), item.Value)
+}
+
+// CompareAndSwap stores an item only if it was not modified since
+// it was fetched with Gets
+func (c *ClientImpl) CompareAndSwap(item *Item) error {
+	return c.store(fmt.Sprintf("cas %s 0 %d %d %d", item.Key, item.Expiration, len(item.Value), item.casID), item.Value)
+}
+
+func (c *ClientImpl) store(command string, value []byte) error {
+	return c.do(func(cn *conn) error {
+		if _, err := fmt.Fprintf(cn.rw, "%s\r\n%s\r\n", command, value); err != nil {
+			return fmt.Errorf("error sending command: %w", err)
+		}
+		if err := cn.rw.Flush(); err != nil {
+			return fmt.Errorf("error sending command: %w", err)
+		}
+		line, err := readLine(cn.rw.Reader)
+		if err != nil {
+			return err
+		}
+		switch line {
+		case "STORED":
+			return nil
+		case "NOT_STORED", "NOT_FOUND":
+			return ErrNotStored
+		case "EXISTS":
+			return ErrCASConflict
+		}
+		if err := checkError(line); err != nil {
+			return err
+		}
+		return fmt.Errorf("unexpected store result: %s", line)
+	})
+}
+
+func (c *ClientImpl) Delete(key string) error {
+	return c.do(func(cn *conn) error {
+		if _, err := fmt.Fprintf(cn.rw, "delete %s\r\n", key); err != nil {
+			return fmt.Errorf("error sending command: %w", err)
+		}
+		if err := cn.rw.Flush(); err != nil {
+			return fmt.Errorf("error sending command: %w", err)
+		}
+		line, err := readLine(cn.rw.Reader)
+		if err != nil {
+			return err
+		}
+		if line == "DELETED" || line == "NOT_FOUND" {
+			return nil
+		}
+		if err := checkError(line); err != nil {
+			return err
+		}
+		return fmt.Errorf("unexpected delete result: %s", line)
+	})
+}
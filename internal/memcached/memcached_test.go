@@ -0,0 +1,150 @@
+package memcached
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nzin/traefik-cluster-ratelimit/internal/memcached/memcachedtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	t.Run("happy path: ping", func(t *testing.T) {
+		server, err := memcachedtest.NewServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		client, err := NewClient(server.Addr, 2*time.Second)
+		require.NoError(t, err)
+		defer client.Close()
+
+		assert.Nil(t, client.Ping())
+	})
+
+	t.Run("add, gets, cas and delete", func(t *testing.T) {
+		server, err := memcachedtest.NewServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		client, err := NewClient(server.Addr, 2*time.Second)
+		require.NoError(t, err)
+		defer client.Close()
+
+		_, err = client.Gets("foo")
+		assert.Equal(t, ErrCacheMiss, err)
+
+		assert.Nil(t, client.Add(&Item{Key: "foo", Value: []byte("1")}))
+		assert.Equal(t, ErrNotStored, client.Add(&Item{Key: "foo", Value: []byte("2")}))
+
+		item, err := client.Gets("foo")
+		require.NoError(t, err)
+		assert.Equal(t, "1", string(item.Value))
+
+		// a concurrent update makes the cas fail
+		other, err := client.Gets("foo")
+		require.NoError(t, err)
+		other.Value = []byte("3")
+		assert.Nil(t, client.CompareAndSwap(other))
+
+		item.Value = []byte("2")
+		assert.Equal(t, ErrCASConflict, client.CompareAndSwap(item))
+
+		item, err = client.Gets("foo")
+		require.NoError(t, err)
+		assert.Equal(t, "3", string(item.Value))
+
+		assert.Nil(t, client.Delete("foo"))
+		item.Value = []byte("4")
+		assert.Equal(t, ErrNotStored, client.CompareAndSwap(item))
+		_, err = client.Gets("foo")
+		assert.Equal(t, ErrCacheMiss, err)
+	})
+
+	t.Run("expiration", func(t *testing.T) {
+		server, err := memcachedtest.NewServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		client, err := NewClient(server.Addr, 2*time.Second)
+		require.NoError(t, err)
+		defer client.Close()
+
+		assert.Nil(t, client.Add(&Item{Key: "foo", Value: []byte("1"), Expiration: 1}))
+		time.Sleep(1100 * time.Millisecond)
+		_, err = client.Gets("foo")
+		assert.Equal(t, ErrCacheMiss, err)
+	})
+
+	t.Run("concurrent cas loops", func(t *testing.T) {
+		server, err := memcachedtest.NewServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		client, err := NewClient(server.Addr, 2*time.Second)
+		require.NoError(t, err)
+		defer client.Close()
+
+		require.NoError(t, client.Add(&Item{Key: "counter", Value: []byte{}}))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					item, err := client.Gets("counter")
+					if !assert.NoError(t, err) {
+						return
+					}
+					item.Value = append(item.Value, 'x')
+					err = client.CompareAndSwap(item)
+					if err == ErrCASConflict {
+						continue
+					}
+					assert.NoError(t, err)
+					return
+				}
+			}()
+		}
+		wg.Wait()
+
+		value, ok := server.Get("counter")
+		assert.True(t, ok)
+		assert.Equal(t, "xxxxxxxxxx", string(value))
+	})
+
+	t.Run("closed while in use", func(t *testing.T) {
+		server, err := memcachedtest.NewServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		c, err := NewClient(server.Addr, 2*time.Second)
+		require.NoError(t, err)
+		client := c.(*ClientImpl)
+
+		cn, err := client.get()
+		require.NoError(t, err)
+		client.Close()
+		client.Close()
+
+		// the connection of a request in flight is closed, instead of panicking
+		assert.NotPanics(t, func() { client.put(cn) })
+		_, err = client.Gets("foo")
+		assert.Equal(t, ErrClosed, err)
+	})
+
+	t.Run("server unreachable", func(t *testing.T) {
+		server, err := memcachedtest.NewServer()
+		require.NoError(t, err)
+		addr := server.Addr
+		server.Close()
+
+		client, err := NewClient(addr, 100*time.Millisecond)
+		require.NoError(t, err)
+		defer client.Close()
+
+		assert.NotNil(t, client.Ping())
+	})
+}
@@ -0,0 +1,231 @@
+// Package memcachedtest provides a small in-memory stand-in for a memcached
+// server, speaking the subset of the text protocol used by the memcached client.
+package memcachedtest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	value     []byte
+	casID     uint64
+	expiresAt time.Time
+}
+
+// Server is a stand-in memcached server listening on a random local port
+type Server struct {
+	Addr string
+
+	mu       sync.Mutex
+	listener net.Listener
+	quit     chan struct{}
+	entries  map[string]*entry
+	nextCAS  uint64
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a new stand-in server
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		listener: listener,
+		quit:     make(chan struct{}),
+		entries:  make(map[string]*entry),
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.wg.Add(1)
+			go s.handleConnection(conn)
+		}
+	}()
+	return s, nil
+}
+
+// Close stops the server and waits for the connections to be closed
+func (s *Server) Close() {
+	close(s.quit)
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+// Get returns the value stored for key, if any
+func (s *Server) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.lookup(key)
+	if e == nil {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// lookup returns a non expired entry (s.mu must be held)
+func (s *Server) lookup(key string) *entry {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if !e.expiresAt.IsZero() && time.Now().After(e.expiresAt) {
+		delete(s.entries, key)
+		return nil
+	}
+	return e
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	// make sure the connection is released when the server stops
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+		case <-s.quit:
+			conn.Close()
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			conn.Write([]byte("ERROR\r\n"))
+			continue
+		}
+
+		var response string
+		switch fields[0] {
+		case "version":
+			response = "VERSION 1.6.0-stand-in\r\n"
+		case "gets":
+			response = s.gets(fields[1:])
+		case "delete":
+			response = s.delete(fields[1:])
+		case "add", "cas":
+			// <command> <key> <flags> <exptime> <bytes> [<cas unique>]
+			if len(fields) < 5 {
+				response = "CLIENT_ERROR bad command line format\r\n"
+				break
+			}
+			size, err := strconv.Atoi(fields[4])
+			if err != nil {
+				response = "CLIENT_ERROR bad command line format\r\n"
+				break
+			}
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				return
+			}
+			response = s.store(fields, data[:size])
+		default:
+			response = "ERROR\r\n"
+		}
+		if _, err := conn.Write([]byte(response)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) gets(keys []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sb strings.Builder
+	for _, key := range keys {
+		e := s.lookup(key)
+		if e == nil {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("VALUE %s 0 %d %d\r\n%s\r\n", key, len(e.value), e.casID, e.value))
+	}
+	sb.WriteString("END\r\n")
+	return sb.String()
+}
+
+func (s *Server) delete(args []string) string {
+	if len(args) != 1 {
+		return "CLIENT_ERROR bad command line format\r\n"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lookup(args[0]) == nil {
+		return "NOT_FOUND\r\n"
+	}
+	delete(s.entries, args[0])
+	return "DELETED\r\n"
+}
+
+func (s *Server) store(fields []string, value []byte) string {
+	key := fields[1]
+	exptime, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return "CLIENT_ERROR bad command line format\r\n"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.lookup(key)
+	switch fields[0] {
+	case "add":
+		if e != nil {
+			return "NOT_STORED\r\n"
+		}
+	case "cas":
+		if len(fields) != 6 {
+			return "CLIENT_ERROR bad command line format\r\n"
+		}
+		casID, err := strconv.ParseUint(fields[5], 10, 64)
+		if err != nil {
+			return "CLIENT_ERROR bad command line format\r\n"
+		}
+		if e == nil {
+			return "NOT_FOUND\r\n"
+		}
+		if e.casID != casID {
+			return "EXISTS\r\n"
+		}
+	}
+
+	s.nextCAS++
+	stored := &entry{
+		value: value,
+		casID: s.nextCAS,
+	}
+	switch {
+	case exptime > 30*24*3600:
+		// like memcached, a unix timestamp
+		stored.expiresAt = time.Unix(int64(exptime), 0)
+	case exptime > 0:
+		stored.expiresAt = time.Now().Add(time.Duration(exptime) * time.Second)
+	}
+	s.entries[key] = stored
+	return "STORED\r\n"
+}
@@ -0,0 +1,54 @@
+package peers
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Resolver returns the current list of peers, as "host:port"
+type Resolver interface {
+	Resolve() ([]string, error)
+}
+
+// StaticResolver always returns the same list of peers
+type StaticResolver struct {
+	Peers []string
+}
+
+func (r *StaticResolver) Resolve() ([]string, error) {
+	return r.Peers, nil
+}
+
+// DNSResolver returns one peer per address behind a DNS name (for example a
+// kubernetes headless service), all of them using the same port
+type DNSResolver struct {
+	Name string
+	Port string
+}
+
+// NewDNSResolver creates a DNSResolver from a "name:port" string
+func NewDNSResolver(hostport string) (*DNSResolver, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peers dns name %q: %v", hostport, err)
+	}
+	return &DNSResolver{
+		Name: host,
+		Port: port,
+	}, nil
+}
+
+func (r *DNSResolver) Resolve() ([]string, error) {
+	addrs, err := net.LookupHost(r.Name)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(addrs)
+
+	peers := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		peers = append(peers, net.JoinHostPort(addr, r.Port))
+	}
+	return peers, nil
+}
@@ -0,0 +1,64 @@
+package peers
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// number of points each member gets on the ring, to spread the keys evenly
+const DEFAULT_REPLICAS = 64
+
+// Ring is a consistent hash ring: each key is owned by one member, and when a
+// member leaves (or joins), only its keys move to another member
+type Ring struct {
+	hashes  []uint32
+	owners  map[uint32]string
+	members []string
+}
+
+// NewRing creates a ring with the given members
+func NewRing(members []string, replicas int) *Ring {
+	if replicas < 1 {
+		replicas = DEFAULT_REPLICAS
+	}
+
+	r := &Ring{
+		hashes:  make([]uint32, 0, len(members)*replicas),
+		owners:  make(map[uint32]string, len(members)*replicas),
+		members: append([]string{}, members...),
+	}
+	sort.Strings(r.members)
+
+	for _, member := range r.members {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + member))
+			if _, ok := r.owners[h]; ok {
+				// collision: keep the first member to have the same result everywhere
+				continue
+			}
+			r.owners[h] = member
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// Members returns the (sorted) members of the ring
+func (r *Ring) Members() []string {
+	return r.members
+}
+
+// Get returns the member owning the key, or "" if the ring is empty
+func (r *Ring) Get(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
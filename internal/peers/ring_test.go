@@ -0,0 +1,47 @@
+package peers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing(t *testing.T) {
+	t.Run("empty ring", func(t *testing.T) {
+		ring := NewRing(nil, 0)
+		assert.Equal(t, "", ring.Get("foo"))
+	})
+
+	t.Run("same result whatever the members order", func(t *testing.T) {
+		ring1 := NewRing([]string{"10.0.0.1:7946", "10.0.0.2:7946", "10.0.0.3:7946"}, 0)
+		ring2 := NewRing([]string{"10.0.0.3:7946", "10.0.0.1:7946", "10.0.0.2:7946"}, 0)
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("192.168.0.%d", i)
+			assert.Equal(t, ring1.Get(key), ring2.Get(key))
+		}
+	})
+
+	t.Run("keys are spread and only the keys of a leaving member move", func(t *testing.T) {
+		members := []string{"10.0.0.1:7946", "10.0.0.2:7946", "10.0.0.3:7946"}
+		ring := NewRing(members, 0)
+		smaller := NewRing(members[:2], 0)
+
+		owned := map[string]int{}
+		for i := 0; i < 3000; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			owner := ring.Get(key)
+			owned[owner]++
+
+			if owner != members[2] {
+				assert.Equal(t, owner, smaller.Get(key))
+			} else {
+				assert.NotEqual(t, members[2], smaller.Get(key))
+			}
+		}
+
+		for _, member := range members {
+			assert.Greater(t, owned[member], 500, member)
+		}
+	})
+}
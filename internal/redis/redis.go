@@ -335,8 +335,9 @@ func (r *ClientImpl) Del(key string) error {
 		return err
 	}
 
-	if res.Success != RESP_SUCCESS && res.Result != "OK" {
-		return fmt.Errorf("DEL result error: %s", res.Result)
+	// DEL answers the number of keys deleted
+	if res.Success == RESP_FAIL {
+		return fmt.Errorf("DEL result error: %v", res.Result)
 	}
 	return nil
 }
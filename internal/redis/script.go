@@ -32,7 +32,7 @@ func (rs *ScriptImpl) Run(keys []string, args ...interface{}) (interface{}, erro
 	}
 	defer rs.client.put(conn)
 
-	argsarray, err := convertToStringArray(args)
+	argsarray, err := convertToStringArray(args...)
 	if err != nil {
 		return "", err
 	}
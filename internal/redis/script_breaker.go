@@ -1,43 +1,32 @@
 package redis
 
 import (
-	"fmt"
-	"time"
+	"github.com/nzin/traefik-cluster-ratelimit/internal/breaker"
 )
 
 type ScriptWithBreaker struct {
-	script           Script
-	errorCount       int64
-	nextAttempt      time.Time
-	breakerThreshold int64
-	reattemptPeriod  int64
+	script  Script
+	breaker *breaker.Breaker
 }
 
 func NewScriptWithBreaker(script Script, breakerThreshold int64, reattemptPeriod int64) Script {
 	return &ScriptWithBreaker{
-		script:           script,
-		errorCount:       0,
-		nextAttempt:      time.Now(),
-		breakerThreshold: breakerThreshold,
-		reattemptPeriod:  reattemptPeriod,
+		script:  script,
+		breaker: breaker.NewBreaker(breakerThreshold, reattemptPeriod),
 	}
 }
 
-func (swb *ScriptWithBreaker) Run(keys []string, args ...interface{}) (interface{}, error) {
-	if swb.errorCount < 3 || time.Now().After(swb.nextAttempt) {
-		res, err := swb.script.Run(keys, args...)
-
-		if err != nil {
-			swb.errorCount++
-			if swb.errorCount == swb.breakerThreshold {
-				swb.nextAttempt = time.Now().Add(time.Duration(swb.reattemptPeriod) * time.Second)
-			}
-		} else {
-			swb.errorCount = 0
-		}
-
-		return res, err
-	} else {
-		return nil, fmt.Errorf("breaker opened")
+// NewScriptWithSharedBreaker wraps a script with an existing breaker, so that
+// several scripts talking to the same server open (and close) together
+func NewScriptWithSharedBreaker(script Script, b *breaker.Breaker) Script {
+	return &ScriptWithBreaker{
+		script:  script,
+		breaker: b,
 	}
 }
+
+func (swb *ScriptWithBreaker) Run(keys []string, args ...interface{}) (interface{}, error) {
+	return swb.breaker.Run(func() (interface{}, error) {
+		return swb.script.Run(keys, args...)
+	})
+}
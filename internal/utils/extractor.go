@@ -52,6 +52,8 @@ type SourceCriterion struct {
 	RequestHeaderName string `json:"requestHeaderName,omitempty" toml:"requestHeaderName,omitempty" yaml:"requestHeaderName,omitempty" export:"true"`
 	// RequestHost defines whether to consider the request Host as the source.
 	RequestHost bool `json:"requestHost,omitempty" toml:"requestHost,omitempty" yaml:"requestHost,omitempty" export:"true"`
+	// Global defines whether all the requests share the same source (a constant "global" key).
+	Global bool `json:"global,omitempty" toml:"global,omitempty" yaml:"global,omitempty" export:"true"`
 }
 
 // GetSourceExtractor returns the SourceExtractor function corresponding to the given sourceMatcher.
@@ -68,11 +70,14 @@ func GetSourceExtractor(sourceMatcher *SourceCriterion) (SourceExtractor, error)
 		if sourceMatcher.RequestHeaderName != "" && sourceMatcher.RequestHost {
 			return nil, errors.New("requestHost and RequestHeaderName are mutually exclusive")
 		}
+		if sourceMatcher.Global && (sourceMatcher.IPStrategy != nil || sourceMatcher.RequestHeaderName != "" || sourceMatcher.RequestHost) {
+			return nil, errors.New("global and the other criteria are mutually exclusive")
+		}
 	}
 
 	if sourceMatcher == nil ||
 		sourceMatcher.IPStrategy == nil &&
-			sourceMatcher.RequestHeaderName == "" && !sourceMatcher.RequestHost {
+			sourceMatcher.RequestHeaderName == "" && !sourceMatcher.RequestHost && !sourceMatcher.Global {
 		sourceMatcher = &SourceCriterion{
 			IPStrategy: &IPStrategy{},
 		}
@@ -91,6 +96,12 @@ func GetSourceExtractor(sourceMatcher *SourceCriterion) (SourceExtractor, error)
 		}), nil
 	}
 
+	if sourceMatcher.Global {
+		return ExtractorFunc(func(req *http.Request) (string, int64, error) {
+			return "global", 1, nil
+		}), nil
+	}
+
 	if sourceMatcher.RequestHeaderName != "" {
 		//logger.Debug().Msg("Using RequestHeaderName")
 		return NewExtractor(fmt.Sprintf("request.header.%s", sourceMatcher.RequestHeaderName))
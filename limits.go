@@ -0,0 +1,145 @@
+package traefik_cluster_ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nzin/traefik-cluster-ratelimit/internal/utils"
+)
+
+// LimitConfig is one of the limits of Config.Limits
+type LimitConfig struct {
+	// Average is the maximum rate, in requests per Period
+	Average int64 `json:"average" yaml:"average"`
+	// Burst is the maximum number of requests allowed to arrive at once
+	Burst int64 `json:"burst" yaml:"burst"`
+	// Period, in seconds, defaults to a second
+	Period int64 `json:"period,omitempty" yaml:"period,omitempty"`
+}
+
+// newLimit validates a limit of Config.Limits or Config.Policies
+func newLimit(config LimitConfig) (Limit, error) {
+	if config.Average < 1 {
+		return Limit{}, fmt.Errorf("average must be >=1")
+	}
+	if config.Burst < 1 {
+		return Limit{}, fmt.Errorf("burst must be >=1")
+	}
+	if config.Period < 1 {
+		config.Period = 1
+	}
+	return Limit{
+		Rate:   config.Average,
+		Burst:  config.Burst,
+		Period: time.Duration(config.Period) * time.Second,
+	}, nil
+}
+
+// policy is one of the limits checked together, in a single script call
+type policy struct {
+	// name is empty for the limits of Config.Limits
+	name  string
+	limit Limit
+	// sourceMatcher is nil to use the source of the middleware
+	sourceMatcher utils.SourceExtractor
+}
+
+// newLimits validates the configured list of limits
+func newLimits(configs []LimitConfig) ([]policy, error) {
+	policies := make([]policy, 0, len(configs))
+	keys := map[string]bool{}
+	for i, config := range configs {
+		limit, err := newLimit(config)
+		if err != nil {
+			return nil, fmt.Errorf("limits[%d]: %v", i, err)
+		}
+		// the limits share their state by key
+		if keys[limitKey(limit)] {
+			return nil, fmt.Errorf("limits[%d]: duplicated limit", i)
+		}
+		keys[limitKey(limit)] = true
+		policies = append(policies, policy{limit: limit})
+	}
+	return policies, nil
+}
+
+// limitKey identifies a limit of Config.Limits by its values, and not by its
+// position, so that reordering the limits keeps their state
+func limitKey(limit Limit) string {
+	return fmt.Sprintf("%d/%d/%d", limit.Rate, limit.Burst, int64(limit.Period/time.Second))
+}
+
+// limit returns the limit of the middleware, scaled in adaptive mode
+func (rl *ClusterRateLimit) limit(req *http.Request, source string) Limit {
+	limit := Limit{
+		Rate:   rl.average,
+		Burst:  rl.burst,
+		Period: time.Duration(rl.period) * time.Second,
+	}
+	if rl.tiers != nil {
+		limit = rl.tiers.limit(req)
+	}
+	base := limit
+	if rl.adaptive != nil {
+		limit = rl.adaptive.scale(limit)
+	}
+	if rl.fairShare != nil {
+		limit = rl.fairShare.share(source, limit)
+	}
+	// an override of the limit of the source is scaled the same way
+	if limit.Rate != base.Rate || limit.Burst != base.Burst {
+		limit.RateFactor = float64(limit.Rate) / float64(base.Rate)
+		limit.BurstFactor = float64(limit.Burst) / float64(base.Burst)
+	}
+	return limit
+}
+
+// allow decides whether n requests from the source may happen now, checking
+// all the limits (or policies) at once if there are several of them. It also
+// returns the name of the policy rejecting the request, if any
+func (rl *ClusterRateLimit) allow(req *http.Request, source string, n int) (*Result, string, func(), error) {
+	if len(rl.policies) == 0 {
+		limit := rl.limit(req, source)
+		if len(rl.priorityClasses) > 0 {
+			// checked by the script, atomically with the consumption
+			limit.Reserve = rl.priorityClass(req, source).Reserve
+		}
+		res, doneWaiting, err := rl.allowOrReserve(rl.bucket(source), limit, n)
+		return res, "", doneWaiting, err
+	}
+
+	names := make([]string, len(rl.policies))
+	keys := make([]string, len(rl.policies))
+	limits := make([]Limit, len(rl.policies))
+	for i, p := range rl.policies {
+		names[i] = p.name
+		limits[i] = p.limit
+		if p.name == "" {
+			// the limit keys have no colon: the source cannot forge another key
+			keys[i] = source + ":" + limitKey(p.limit)
+			continue
+		}
+		keys[i] = source
+		if p.sourceMatcher != nil {
+			policySource, _, err := p.sourceMatcher.Extract(req)
+			if err != nil {
+				return nil, "", nil, fmt.Errorf("could not extract source of policy %s: %v", p.name, err)
+			}
+			keys[i] = policySource
+		}
+	}
+
+	var res *Result
+	var index int
+	var err error
+	if names[0] == "" {
+		res, index, err = rl.redis.AllowNAll(keys, limits, n)
+	} else {
+		res, index, err = rl.redis.AllowNPolicies(names, keys, limits, n)
+	}
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return res, rl.policies[index].name, func() {}, nil
+}
@@ -0,0 +1,70 @@
+package traefik_cluster_ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLimits(t *testing.T) {
+	_, err := newLimits([]LimitConfig{{Average: 10, Burst: 10}, {Average: 10, Burst: 0}})
+	assert.Error(t, err)
+	_, err = newLimits([]LimitConfig{{Average: 10, Burst: 10}, {Average: 10, Burst: 10, Period: 1}})
+	assert.Error(t, err)
+}
+
+func TestLimits(t *testing.T) {
+	config := &Config{
+		Limits: []LimitConfig{
+			{Average: 100, Burst: 100, Period: 1},
+			{Average: 2, Burst: 2, Period: 60},
+		},
+		Headers: true,
+	}
+	rl, server := newTestMiddleware(t, config, func(rw http.ResponseWriter, req *http.Request) {})
+	server.SetTime(time.Now())
+
+	serve := func(rl *ClusterRateLimit) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "1.2.3.4:1234"
+		rl.ServeHTTP(rw, req)
+		return rw
+	}
+
+	for i := 0; i < 2; i++ {
+		rw := serve(rl)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "2", rw.Header().Get("X-RateLimit-Limit"))
+	}
+	rw := serve(rl)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	// the limits have no name
+	assert.Empty(t, rw.Header().Get("X-RateLimit-Policy"))
+
+	// reordering the limits keeps their state
+	handler, err := New(context.Background(), nil, &Config{
+		Limits:       []LimitConfig{config.Limits[1], config.Limits[0]},
+		RedisAddress: server.Addr(),
+	}, t.Name())
+	require.NoError(t, err)
+	rw = serve(handler.(*ClusterRateLimit))
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+}
+
+func TestLimitFactors(t *testing.T) {
+	rl := &ClusterRateLimit{average: 10, burst: 20, period: 1}
+	assert.Equal(t, Limit{Rate: 10, Burst: 20, Period: time.Second}, rl.limit(httptest.NewRequest(http.MethodGet, "/", nil), "source"))
+
+	// the overrides are scaled like the limit
+	rl.adaptive = &adaptiveLimit{factor: 0.5}
+	limit := rl.limit(httptest.NewRequest(http.MethodGet, "/", nil), "source")
+	assert.Equal(t, int64(5), limit.Rate)
+	assert.Equal(t, 0.5, limit.RateFactor)
+	assert.Equal(t, 1.0, limit.BurstFactor)
+}
@@ -0,0 +1,76 @@
+package traefik_cluster_ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// number of stores between two sweeps of the expired entries
+const localSweepInterval = 1000
+
+type localEntry struct {
+	tat       float64
+	expiresAt time.Time
+}
+
+// LocalLimiter keeps the GCRA state in memory. It is not shared across Traefik
+// instances by itself, but is used by the peers backend, either for the keys
+// owned by this instance, or as a fallback when the owner is unreachable.
+type LocalLimiter struct {
+	mu      sync.Mutex
+	entries map[string]localEntry
+	stores  int
+}
+
+// NewLocalLimiter returns a new LocalLimiter.
+func NewLocalLimiter() *LocalLimiter {
+	return &LocalLimiter{
+		entries: make(map[string]localEntry),
+	}
+}
+
+// AllowN reports whether n events may happen at time now.
+func (l *LocalLimiter) AllowN(key string, limit Limit, n int) (*Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := gcraNow()
+	tat := now
+	if e, ok := l.entries[key]; ok && time.Now().Before(e.expiresAt) {
+		tat = e.tat
+	}
+
+	newTat, res := gcra(tat, now, limit, n)
+	if newTat != 0 {
+		l.entries[key] = localEntry{
+			tat:       newTat,
+			expiresAt: time.Now().Add(res.ResetAfter),
+		}
+		l.stores++
+		if l.stores >= localSweepInterval {
+			l.sweep()
+		}
+	}
+	return res, nil
+}
+
+// sweep removes the expired entries (l.mu must be held)
+func (l *LocalLimiter) sweep() {
+	l.stores = 0
+	now := time.Now()
+	for key, e := range l.entries {
+		if now.After(e.expiresAt) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// Reset gets a key and reset all limitations and previous usages
+func (l *LocalLimiter) Reset(ctx context.Context, key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.entries, key)
+	return nil
+}
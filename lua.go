@@ -1,5 +1,7 @@
 package traefik_cluster_ratelimit
 
+import "fmt"
+
 // Copyright (c) 2017 Pavel Pravosud
 // https://github.com/rwz/redis-gcra/blob/master/vendor/perform_gcra_ratelimit.lua
 var allowNLua = `
@@ -132,3 +134,773 @@ return {
   tostring(reset_after),
 }
 `
+
+// sliding log: at most "limit" requests in any rolling "window" (in seconds).
+// The timestamps of the requests of the last window are kept in a sorted set,
+// and the script trims, counts and adds them in one atomic step
+var slidingLogLua = `
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+local rate_limit_key = KEYS[1]
+-- a counter used to have unique members in the sorted set
+local sequence_key = rate_limit_key .. ":seq"
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+-- same time reference as the gcra scripts
+local jan_1_2024 = 1704085200
+local now = redis.call("TIME")
+now = (now[1] - jan_1_2024) + (now[2] / 1000000)
+
+-- forget the requests that left the window
+redis.call("ZREMRANGEBYSCORE", rate_limit_key, "-inf", now - window)
+local count = redis.call("ZCARD", rate_limit_key)
+
+if count + cost > limit then
+  local reset_after = 0
+  if count > 0 then
+    local newest = redis.call("ZRANGE", rate_limit_key, -1, -1, "WITHSCORES")
+    reset_after = tonumber(newest[2]) + window - now
+  end
+
+  -- the request can pass once enough of the oldest requests left the window
+  local retry_after = window
+  if cost <= limit then
+    local index = count + cost - limit - 1
+    local oldest = redis.call("ZRANGE", rate_limit_key, index, index, "WITHSCORES")
+    retry_after = tonumber(oldest[2]) + window - now
+  end
+  return {
+    0, -- allowed
+    0, -- remaining
+    tostring(retry_after),
+    tostring(reset_after),
+  }
+end
+
+local sequence = redis.call("INCRBY", sequence_key, cost)
+for i = 1, cost do
+  redis.call("ZADD", rate_limit_key, now, tostring(sequence - cost + i))
+end
+local ttl = math.ceil(window * 1000)
+redis.call("PEXPIRE", rate_limit_key, ttl)
+redis.call("PEXPIRE", sequence_key, ttl)
+
+return {
+  cost,
+  limit - count - cost,
+  tostring(-1),
+  tostring(window),
+}
+`
+
+// sliding window counter: an approximation of the sliding log, using only two
+// fixed window counters. The previous window counter is weighted by how much of
+// it is still in the rolling window, assuming its requests were evenly spread.
+// The counters are the fields of a hash, by window index, so that deleting the
+// key resets them
+var slidingWindowLua = `
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+local rate_limit_key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+-- same time reference as the gcra scripts
+local jan_1_2024 = 1704085200
+local now = redis.call("TIME")
+now = (now[1] - jan_1_2024) + (now[2] / 1000000)
+
+local current_window = math.floor(now / window)
+local elapsed = now - current_window * window
+
+local previous = tonumber(redis.call("HGET", rate_limit_key, current_window - 1) or "0")
+local current = tonumber(redis.call("HGET", rate_limit_key, current_window) or "0")
+
+local count = previous * (1 - elapsed / window) + current
+
+if count + cost > limit then
+  local reset_after = (current_window + 1) * window - now
+  if current > 0 then
+    reset_after = reset_after + window
+  end
+
+  local retry_after = reset_after
+  if cost <= limit then
+    if current + cost <= limit then
+      -- the weight of the previous window decreases enough within this window
+      retry_after = window * (1 - (limit - current - cost) / previous) - elapsed
+    else
+      -- the current window becomes the previous one, and its weight has to decrease
+      retry_after = (window - elapsed) + window * (1 - (limit - cost) / current)
+    end
+  end
+  return {
+    0, -- allowed
+    0, -- remaining
+    tostring(retry_after),
+    tostring(reset_after),
+  }
+end
+
+redis.call("HINCRBY", rate_limit_key, current_window, cost)
+-- forget the windows older than the previous one
+for _, field in ipairs(redis.call("HKEYS", rate_limit_key)) do
+  if tonumber(field) < current_window - 1 then
+    redis.call("HDEL", rate_limit_key, field)
+  end
+end
+-- the counter is still used as the previous window during the next window
+redis.call("PEXPIRE", rate_limit_key, math.ceil(window * 2000))
+
+local reset_after = (current_window + 2) * window - now
+return {
+  cost,
+  math.floor(limit - count - cost),
+  tostring(-1),
+  tostring(reset_after),
+}
+`
+
+// fixed window: at most "limit" requests per window of "window" seconds, the
+// windows being aligned on the wall clock (shifted by "offset" seconds, to
+// align them on a timezone). Contrary to the other scripts, the time is not
+// relative to jan_1_2024, and the window boundary is also returned, as an
+// unix timestamp. The counter is the field of a hash, by window index, so
+// that deleting the key resets it
+var fixedWindowLua = `
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+local rate_limit_key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local offset = tonumber(ARGV[4])
+
+local now = redis.call("TIME")
+now = now[1] + (now[2] / 1000000)
+
+local index = math.floor((now + offset) / window)
+local boundary = (index + 1) * window - offset
+local reset_after = boundary - now
+
+local count = redis.call("HINCRBY", rate_limit_key, index, cost)
+if count == cost then
+  -- a new window: forget the previous ones
+  for _, field in ipairs(redis.call("HKEYS", rate_limit_key)) do
+    if tonumber(field) ~= index then
+      redis.call("HDEL", rate_limit_key, field)
+    end
+  end
+  redis.call("EXPIREAT", rate_limit_key, math.ceil(boundary))
+end
+
+if count > limit then
+  -- denied requests are not counted
+  redis.call("HINCRBY", rate_limit_key, index, -cost)
+  return {
+    0, -- allowed
+    0, -- remaining
+    tostring(reset_after),
+    tostring(reset_after),
+    tostring(boundary),
+  }
+end
+
+return {
+  cost,
+  limit - count,
+  tostring(-1),
+  tostring(reset_after),
+  tostring(boundary),
+}
+`
+
+// concurrency: takes one of the "max" slots of a sorted set, as a lease
+// expiring after "lease" seconds. The leases left behind by crashed
+// instances are cleaned up once expired
+var acquireLua = `
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+local slots_key = KEYS[1]
+local max = tonumber(ARGV[1])
+local lease = tonumber(ARGV[2])
+local id = ARGV[3]
+
+-- same time reference as the gcra scripts
+local jan_1_2024 = 1704085200
+local now = redis.call("TIME")
+now = (now[1] - jan_1_2024) + (now[2] / 1000000)
+
+-- forget the expired leases
+redis.call("ZREMRANGEBYSCORE", slots_key, "-inf", now)
+
+local count = redis.call("ZCARD", slots_key)
+if count >= max then
+  return {
+    0, -- acquired
+    0, -- remaining
+  }
+end
+
+redis.call("ZADD", slots_key, now + lease, id)
+redis.call("PEXPIRE", slots_key, math.ceil(lease * 1000))
+return {1, max - count - 1}
+`
+
+// extends a lease taken by acquireLua, unless it already expired
+var renewLua = `
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+local slots_key = KEYS[1]
+local lease = tonumber(ARGV[1])
+local id = ARGV[2]
+
+local jan_1_2024 = 1704085200
+local now = redis.call("TIME")
+now = (now[1] - jan_1_2024) + (now[2] / 1000000)
+
+local renewed = redis.call("ZADD", slots_key, "XX", "CH", now + lease, id)
+if renewed == 1 then
+  redis.call("PEXPIRE", slots_key, math.ceil(lease * 1000))
+end
+return renewed
+`
+
+// releases a slot taken by acquireLua
+var releaseLua = `
+return redis.call("ZREM", KEYS[1], ARGV[1])
+`
+
+// same as allowNLua, but the request can also be delayed: if it would be
+// allowed within "max_delay" seconds, its tokens are reserved right away,
+// and the delay to wait is returned in place of the retry_after
+var reserveNLua = `
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+local rate_limit_key = KEYS[1]
+local burst = ARGV[1]
+local rate = ARGV[2]
+local period = ARGV[3]
+local cost = tonumber(ARGV[4])
+local max_delay = tonumber(ARGV[5])
+
+local emission_interval = period / rate
+local increment = emission_interval * cost
+local burst_offset = emission_interval * burst
+
+-- same time reference as allowNLua
+local jan_1_2024 = 1704085200
+local now = redis.call("TIME")
+now = (now[1] - jan_1_2024) + (now[2] / 1000000)
+
+local tat = redis.call("GET", rate_limit_key)
+
+if not tat then
+  tat = now
+else
+  tat = tonumber(tat)
+end
+
+tat = math.max(tat, now)
+
+local new_tat = tat + increment
+local allow_at = new_tat - burst_offset
+
+local diff = now - allow_at
+local remaining = diff / emission_interval
+
+if diff + max_delay < 0 then
+  local reset_after = tat - now
+  local retry_after = diff * -1
+  return {
+    0, -- allowed
+    0, -- remaining
+    tostring(retry_after),
+    tostring(reset_after),
+  }
+end
+
+local reset_after = new_tat - now
+if reset_after > 0 then
+  redis.call("SET", rate_limit_key, new_tat, "EX", math.ceil(reset_after))
+end
+local delay = math.max(0, diff * -1)
+return {cost, math.max(0, remaining), tostring(delay), tostring(reset_after)}
+`
+
+// several GCRA limits checked at once: the tokens are consumed only if all the
+// limits allow the request. KEYS holds one key per limit, and ARGV the cost,
+// followed by a burst, rate, period triple per limit. The index (0 based) of
+// the most restrictive limit is returned as a fifth element
+var allowNAllLua = `
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+local cost = tonumber(ARGV[1])
+
+-- same time reference as allowNLua
+local jan_1_2024 = 1704085200
+local now = redis.call("TIME")
+now = (now[1] - jan_1_2024) + (now[2] / 1000000)
+
+local new_tats = {}
+local denied_index = nil
+local denied_retry_after = 0
+local denied_reset_after = 0
+local min_index = 1
+local min_remaining = nil
+local max_reset_after = 0
+
+for i, rate_limit_key in ipairs(KEYS) do
+  local burst = tonumber(ARGV[2 + (i - 1) * 3])
+  local rate = tonumber(ARGV[3 + (i - 1) * 3])
+  local period = tonumber(ARGV[4 + (i - 1) * 3])
+
+  local emission_interval = period / rate
+  local increment = emission_interval * cost
+  local burst_offset = emission_interval * burst
+
+  local tat = redis.call("GET", rate_limit_key)
+  if not tat then
+    tat = now
+  else
+    tat = tonumber(tat)
+  end
+  tat = math.max(tat, now)
+
+  local new_tat = tat + increment
+  local allow_at = new_tat - burst_offset
+  local diff = now - allow_at
+  local remaining = diff / emission_interval
+
+  if remaining < 0 then
+    -- the most restrictive denial is the one lasting the longest
+    if not denied_index or -diff > denied_retry_after then
+      denied_index = i
+      denied_retry_after = -diff
+      denied_reset_after = tat - now
+    end
+  else
+    new_tats[i] = new_tat
+    if not min_remaining or remaining < min_remaining then
+      min_index = i
+      min_remaining = remaining
+    end
+    max_reset_after = math.max(max_reset_after, new_tat - now)
+  end
+end
+
+if denied_index then
+  return {
+    0, -- allowed
+    0, -- remaining
+    tostring(denied_retry_after),
+    tostring(denied_reset_after),
+    denied_index - 1,
+  }
+end
+
+for i, rate_limit_key in ipairs(KEYS) do
+  local reset_after = new_tats[i] - now
+  if reset_after > 0 then
+    redis.call("SET", rate_limit_key, new_tats[i], "EX", math.ceil(reset_after))
+  end
+end
+
+return {cost, min_remaining, tostring(-1), tostring(max_reset_after), min_index - 1}
+`
+
+// checks, without consuming anything, that a GCRA key has at least one token
+// left (it may be in debt after ChargeN). It returns the same array as allowNLua
+var checkLua = `
+local rate_limit_key = KEYS[1]
+local burst = ARGV[1]
+local rate = ARGV[2]
+local period = ARGV[3]
+
+local emission_interval = period / rate
+local burst_offset = emission_interval * burst
+
+-- same time reference as allowNLua
+local jan_1_2024 = 1704085200
+local now = redis.call("TIME")
+now = (now[1] - jan_1_2024) + (now[2] / 1000000)
+
+local tat = redis.call("GET", rate_limit_key)
+
+if not tat then
+  tat = now
+else
+  tat = tonumber(tat)
+end
+
+tat = math.max(tat, now)
+
+local allow_at = tat + emission_interval - burst_offset
+local diff = now - allow_at
+local reset_after = tat - now
+
+if diff < 0 then
+  return {0, 0, tostring(diff * -1), tostring(reset_after)}
+end
+return {1, diff / emission_interval + 1, tostring(-1), tostring(reset_after)}
+`
+
+// calendar quotas: a counter per period (hour, day, week, month), the period
+// boundaries being computed by the caller, as unix timestamps, because they
+// depend on the timezone
+var quotaLua = `
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+local quota_key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local cost = tonumber(ARGV[2])
+local boundary = tonumber(ARGV[3])
+
+local now = redis.call("TIME")
+now = now[1] + (now[2] / 1000000)
+local reset_after = math.max(0, boundary - now)
+
+local count = redis.call("INCRBY", quota_key, cost)
+if count == cost then
+  redis.call("EXPIREAT", quota_key, math.ceil(boundary))
+end
+
+if count > limit then
+  -- denied requests are not counted
+  redis.call("DECRBY", quota_key, cost)
+  return {
+    0, -- allowed
+    math.max(0, limit - count + cost), -- remaining
+    tostring(reset_after),
+    tostring(reset_after),
+    tostring(boundary),
+  }
+end
+
+return {
+  cost,
+  limit - count,
+  tostring(-1),
+  tostring(reset_after),
+  tostring(boundary),
+}
+`
+
+// distinct-value limits: a HyperLogLog of the values seen by a key until the
+// "boundary" timestamp. Once the count reaches the limit, only the values
+// already seen are allowed: the new ones are tested on a scratch copy (KEYS[2],
+// derived from KEYS[1]), so that the rejected values are not counted
+var distinctLua = `
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+local distinct_key = KEYS[1]
+local scratch_key = KEYS[2]
+local value = ARGV[1]
+local limit = tonumber(ARGV[2])
+local boundary = tonumber(ARGV[3])
+
+local now = redis.call("TIME")
+now = now[1] + (now[2] / 1000000)
+local reset_after = math.max(0, boundary - now)
+
+local count = redis.call("PFCOUNT", distinct_key)
+if count >= limit then
+  redis.call("PFMERGE", scratch_key, distinct_key)
+  local new = redis.call("PFADD", scratch_key, value)
+  redis.call("DEL", scratch_key)
+  if new == 1 then
+    return {
+      0, -- allowed
+      0, -- remaining
+      tostring(reset_after),
+      tostring(reset_after),
+      tostring(boundary),
+    }
+  end
+else
+  redis.call("PFADD", distinct_key, value)
+  redis.call("EXPIREAT", distinct_key, math.ceil(boundary))
+  count = redis.call("PFCOUNT", distinct_key)
+end
+
+return {
+  1,
+  math.max(0, limit - count),
+  tostring(-1),
+  tostring(reset_after),
+  tostring(boundary),
+}
+`
+
+// adaptive limits: the health factor shared by all the instances, updated
+// with additive-increase/multiplicative-decrease. Each direction is applied
+// at most once per interval, whatever the number of instances reporting
+var adaptiveLua = `
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+local factor_key = KEYS[1]
+local healthy = tonumber(ARGV[1]) == 1
+local increase = tonumber(ARGV[2])
+local decrease = tonumber(ARGV[3])
+local floor = tonumber(ARGV[4])
+local ceiling = tonumber(ARGV[5])
+local interval = tonumber(ARGV[6])
+
+local now = redis.call("TIME")
+now = now[1] + (now[2] / 1000000)
+
+local state = redis.call("HMGET", factor_key, "factor", "decreased_at", "increased_at")
+local factor = tonumber(state[1]) or ceiling
+local decreased_at = tonumber(state[2]) or 0
+local increased_at = tonumber(state[3]) or 0
+
+if not healthy then
+  if now - decreased_at >= interval then
+    factor = factor * decrease
+    decreased_at = now
+  end
+elseif now - decreased_at >= interval and now - increased_at >= interval then
+  factor = factor + increase
+  increased_at = now
+end
+factor = math.min(ceiling, math.max(floor, factor))
+
+redis.call("HSET", factor_key, "factor", tostring(factor), "decreased_at", tostring(decreased_at), "increased_at", tostring(increased_at))
+-- back to the ceiling when nobody reports anymore
+redis.call("EXPIRE", factor_key, math.ceil(interval * 10))
+return tostring(factor)
+`
+
+// the sorted set of the sources (by last seen time) of the fair-share limits.
+// ARGV are the window, in seconds, and the sources seen since the last call
+var activeSourcesLua = `
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+local active_key = KEYS[1]
+local window = tonumber(ARGV[1])
+
+local now = redis.call("TIME")
+now = now[1] + (now[2] / 1000000)
+
+for i = 2, #ARGV do
+  redis.call("ZADD", active_key, now, ARGV[i])
+end
+redis.call("ZREMRANGEBYSCORE", active_key, "-inf", now - window)
+redis.call("EXPIRE", active_key, math.ceil(window * 2))
+return redis.call("ZCARD", active_key)
+`
+
+// the GCRA of allowNLua, with a penalty box: a key rejected more than
+// "threshold" times within "window" seconds is banned, for "ban" seconds
+// doubling at each recurrence, up to "max_ban" seconds. KEYS are the rate
+// limit key, the ban key, the rejections counter and the recurrence level.
+// A fifth element is 1 when the key was just banned, 2 when it already was
+var penaltyLua = `
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+local rate_limit_key = KEYS[1]
+local ban_key = KEYS[2]
+local rejections_key = KEYS[3]
+local level_key = KEYS[4]
+local burst = ARGV[1]
+local rate = ARGV[2]
+local period = ARGV[3]
+local cost = tonumber(ARGV[4])
+local threshold = tonumber(ARGV[5])
+local window = tonumber(ARGV[6])
+local ban = tonumber(ARGV[7])
+local max_ban = tonumber(ARGV[8])
+
+local ban_ttl = redis.call("PTTL", ban_key)
+if ban_ttl > 0 then
+  local ban_after = ban_ttl / 1000
+  return {0, 0, tostring(ban_after), tostring(ban_after), 2}
+end
+
+local emission_interval = period / rate
+local increment = emission_interval * cost
+local burst_offset = emission_interval * burst
+
+-- same time reference as allowNLua
+local jan_1_2024 = 1704085200
+local now = redis.call("TIME")
+now = (now[1] - jan_1_2024) + (now[2] / 1000000)
+
+local tat = redis.call("GET", rate_limit_key)
+
+if not tat then
+  tat = now
+else
+  tat = tonumber(tat)
+end
+
+tat = math.max(tat, now)
+
+local new_tat = tat + increment
+local allow_at = new_tat - burst_offset
+
+local diff = now - allow_at
+local remaining = diff / emission_interval
+
+if remaining < 0 then
+  local rejections = redis.call("INCR", rejections_key)
+  if rejections == 1 then
+    redis.call("EXPIRE", rejections_key, window)
+  end
+
+  if rejections > threshold then
+    local level = redis.call("INCR", level_key)
+    local duration = math.min(max_ban, ban * math.pow(2, level - 1))
+    redis.call("SET", ban_key, 1, "PX", math.ceil(duration * 1000))
+    redis.call("DEL", rejections_key)
+    -- the recurrences are forgotten max_ban seconds after the end of the ban
+    redis.call("EXPIRE", level_key, math.ceil(duration + max_ban))
+    return {0, 0, tostring(duration), tostring(duration), 1}
+  end
+
+  local reset_after = tat - now
+  local retry_after = diff * -1
+  return {0, 0, tostring(retry_after), tostring(reset_after), 0}
+end
+
+local reset_after = new_tat - now
+if reset_after > 0 then
+  redis.call("SET", rate_limit_key, new_tat, "EX", math.ceil(reset_after))
+end
+return {cost, remaining, tostring(-1), tostring(reset_after), 0}
+`
+
+// reverse GCRA step: gives back the cost of events consumed by allowNLua,
+// without ever moving the TAT before now (which would give more than the burst)
+var refundLua = `
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+local rate_limit_key = KEYS[1]
+local burst = ARGV[1]
+local rate = ARGV[2]
+local period = ARGV[3]
+local cost = tonumber(ARGV[4])
+
+local emission_interval = period / rate
+local increment = emission_interval * cost
+
+-- same time reference as allowNLua
+local jan_1_2024 = 1704085200
+local now = redis.call("TIME")
+now = (now[1] - jan_1_2024) + (now[2] / 1000000)
+
+local tat = redis.call("GET", rate_limit_key)
+if not tat then
+  return 0
+end
+
+local new_tat = math.max(now, tonumber(tat) - increment)
+local reset_after = new_tat - now
+if reset_after > 0 then
+  redis.call("SET", rate_limit_key, new_tat, "EX", math.ceil(reset_after))
+else
+  redis.call("DEL", rate_limit_key)
+end
+return 1
+`
+
+// withOverride makes a script look up the per-key override of the limit
+// (see SetOverride), whose key is passed as the last of KEYS, before running.
+// The override, scaled by the rate and burst factors of the limit, replaces
+// the burst, rate and period arguments (0 when the script has no such
+// argument), and is added to the returned array: the effective rate, burst
+// and period follow the optional reset time. The last three of ARGV are the
+// rate factor, the burst factor, and the reserve of the priority class, taken
+// out of the burst whether it is overridden or not.
+func withOverride(script string, burstArg, rateArg, periodArg int) string {
+	return fmt.Sprintf(`
+local reserve = tonumber(table.remove(ARGV))
+local burst_factor = tonumber(table.remove(ARGV))
+local rate_factor = tonumber(table.remove(ARGV))
+
+local override = redis.call("HMGET", KEYS[#KEYS], "rate", "burst", "period")
+local overridden = override[1] and override[2] and override[3]
+if overridden then
+  -- scaled like the configured limit, by the adaptive and fair-share modes
+  override[1] = tostring(math.max(1, math.floor(tonumber(override[1]) * rate_factor + 0.5)))
+  override[2] = tostring(math.max(1, math.floor(tonumber(override[2]) * burst_factor + 0.5)))
+  if %[1]d > 0 then ARGV[%[1]d] = override[2] end
+  if %[2]d > 0 then ARGV[%[2]d] = override[1] end
+  if %[3]d > 0 then ARGV[%[3]d] = override[3] end
+end
+if %[1]d > 0 and reserve > 0 then
+  ARGV[%[1]d] = tonumber(ARGV[%[1]d]) - reserve
+end
+
+local result = (function()
+%[4]s
+end)()
+
+if overridden and type(result) == "table" then
+  -- no reset time
+  if #result == 4 then
+    result[5] = ""
+  end
+  table.insert(result, 6, override[1])
+  table.insert(result, 7, override[2])
+  table.insert(result, 8, override[3])
+end
+return result
+`, burstArg, rateArg, periodArg, script)
+}
+
+// sets the override of a key, as a hash with rate, burst and period fields,
+// expiring after ARGV[4] milliseconds (0 for no expiry)
+var setOverrideLua = `
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+redis.call("DEL", KEYS[1])
+redis.call("HSET", KEYS[1], "rate", ARGV[1], "burst", ARGV[2], "period", ARGV[3])
+local ttl = tonumber(ARGV[4])
+if ttl > 0 then
+  redis.call("PEXPIRE", KEYS[1], ttl)
+end
+return 1
+`
+
+// lists a page of the overrides whose key starts with ARGV[1], scanning from
+// the cursor ARGV[2]: the next cursor ("0" at the end) is followed by an array
+// of key, rate, burst, period, and time to live (in milliseconds, -1 for no
+// expiry)
+var listOverridesLua = `
+local page = redis.call("SCAN", ARGV[2], "MATCH", ARGV[1] .. "*", "COUNT", 1000)
+local overrides = {page[1]}
+for _, key in ipairs(page[2]) do
+  local override = redis.call("HMGET", key, "rate", "burst", "period")
+  if override[1] and override[2] and override[3] then
+    table.insert(overrides, key)
+    table.insert(overrides, override[1])
+    table.insert(overrides, override[2])
+    table.insert(overrides, override[3])
+    table.insert(overrides, redis.call("PTTL", key))
+  end
+end
+return overrides
+`
+
+// HGET, returning "" for a missing field
+var hashGetLua = `
+return redis.call("HGET", KEYS[1], ARGV[1]) or ""
+`
@@ -0,0 +1,113 @@
+package traefik_cluster_ratelimit
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/nzin/traefik-cluster-ratelimit/internal/breaker"
+	"github.com/nzin/traefik-cluster-ratelimit/internal/memcached"
+)
+
+// number of gets/cas round trips before giving up on a contended key
+const memcachedCASRetries = 10
+
+// MemcachedLimiter is a Limiter storing the GCRA theoretical arrival time
+// into memcached. As memcached cannot run scripts, the GCRA step is done
+// locally and stored with a gets/cas loop. Contrary to Redis, the time comes
+// from the Traefik instances, so their clocks must be kept in sync.
+type MemcachedLimiter struct {
+	client  memcached.Client
+	breaker *breaker.Breaker
+	prefix  string
+}
+
+// NewMemcachedLimiter returns a new MemcachedLimiter.
+func NewMemcachedLimiter(client memcached.Client, prefix string, breakerThreshold, breakerReattempt int64) *MemcachedLimiter {
+	return &MemcachedLimiter{
+		client:  client,
+		breaker: breaker.NewBreaker(breakerThreshold, breakerReattempt),
+		prefix:  "rate_" + prefix,
+	}
+}
+
+// AllowN reports whether n events may happen at time now.
+func (l *MemcachedLimiter) AllowN(key string, limit Limit, n int) (*Result, error) {
+	res, err := l.breaker.Run(func() (interface{}, error) {
+		return l.allowN(l.memcachedKey(key), limit, n)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*Result), nil
+}
+
+func (l *MemcachedLimiter) allowN(key string, limit Limit, n int) (*Result, error) {
+	for i := 0; i < memcachedCASRetries; i++ {
+		now := gcraNow()
+		tat := now
+
+		item, err := l.client.Gets(key)
+		if err != nil && err != memcached.ErrCacheMiss {
+			return nil, err
+		}
+		if item != nil {
+			if tat, err = strconv.ParseFloat(string(item.Value), 64); err != nil {
+				return nil, fmt.Errorf("invalid value stored for %s: %v", key, err)
+			}
+		}
+
+		newTat, res := gcra(tat, now, limit, n)
+		if newTat == 0 {
+			return res, nil
+		}
+
+		value := []byte(strconv.FormatFloat(newTat, 'f', -1, 64))
+		// longer expirations would be read as unix timestamps
+		expiration := int32(math.Min(math.Ceil(res.ResetAfter.Seconds()), memcached.MaxExpiration))
+		if item == nil {
+			err = l.client.Add(&memcached.Item{Key: key, Value: value, Expiration: expiration})
+		} else {
+			item.Value = value
+			item.Expiration = expiration
+			err = l.client.CompareAndSwap(item)
+		}
+		if err == memcached.ErrNotStored || err == memcached.ErrCASConflict {
+			// someone else updated the key in between, let's try again
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("too much contention on %s", key)
+}
+
+// Reset gets a key and reset all limitations and previous usages
+func (l *MemcachedLimiter) Reset(ctx context.Context, key string) error {
+	return l.client.Delete(l.memcachedKey(key))
+}
+
+// memcachedKey returns a key usable with the text protocol: keys are
+// limited to 250 characters, without spaces nor control characters
+func (l *MemcachedLimiter) memcachedKey(key string) string {
+	k := l.prefix + key
+	if len(k) <= 250 && isValidMemcachedKey(k) {
+		return k
+	}
+	sum := sha1.Sum([]byte(key))
+	return l.prefix + "sha1_" + hex.EncodeToString(sum[:])
+}
+
+func isValidMemcachedKey(key string) bool {
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package traefik_cluster_ratelimit
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nzin/traefik-cluster-ratelimit/internal/memcached"
+	"github.com/nzin/traefik-cluster-ratelimit/internal/memcached/memcachedtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemcachedLimiter(t *testing.T) {
+	server, err := memcachedtest.NewServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := memcached.NewClient(server.Addr, 2*time.Second)
+	require.NoError(t, err)
+	defer client.Close()
+
+	limiter := NewMemcachedLimiter(client, "test", 3, 15)
+	limit := Limit{Rate: 10, Burst: 3, Period: time.Minute}
+
+	t.Run("burst then deny", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			res, err := limiter.AllowN("1.2.3.4", limit, 1)
+			require.NoError(t, err)
+			assert.Equal(t, 1, res.Allowed)
+			assert.Equal(t, 2-i, res.Remaining)
+		}
+
+		res, err := limiter.AllowN("1.2.3.4", limit, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 0, res.Allowed)
+		assert.InDelta(t, 6*time.Second, res.RetryAfter, float64(100*time.Millisecond))
+
+		_, stored := server.Get("rate_test1.2.3.4")
+		assert.True(t, stored)
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		require.NoError(t, limiter.Reset(context.Background(), "1.2.3.4"))
+
+		res, err := limiter.AllowN("1.2.3.4", limit, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 1, res.Allowed)
+	})
+
+	t.Run("keys not valid for memcached are hashed", func(t *testing.T) {
+		key := "some header value " + strings.Repeat("x", 300)
+		res, err := limiter.AllowN(key, limit, 3)
+		require.NoError(t, err)
+		assert.Equal(t, 3, res.Allowed)
+
+		res, err = limiter.AllowN(key, limit, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 0, res.Allowed)
+	})
+
+	t.Run("long periods expire within 30 days", func(t *testing.T) {
+		month := Limit{Rate: 1, Burst: 2, Period: 60 * 24 * time.Hour}
+		res, err := limiter.AllowN("monthly", month, 2)
+		require.NoError(t, err)
+		assert.Equal(t, 2, res.Allowed)
+
+		// a unix timestamp in 1970 would have expired the key at once
+		res, err = limiter.AllowN("monthly", month, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 0, res.Allowed)
+	})
+
+	t.Run("breaker", func(t *testing.T) {
+		unreachable, err := memcachedtest.NewServer()
+		require.NoError(t, err)
+		addr := unreachable.Addr
+		unreachable.Close()
+
+		client, err := memcached.NewClient(addr, 100*time.Millisecond)
+		require.NoError(t, err)
+		limiter := NewMemcachedLimiter(client, "test", 2, 15)
+
+		for i := 0; i < 2; i++ {
+			_, err = limiter.AllowN("1.2.3.4", limit, 1)
+			assert.NotNil(t, err)
+		}
+		_, err = limiter.AllowN("1.2.3.4", limit, 1)
+		assert.EqualError(t, err, "breaker opened")
+	})
+}
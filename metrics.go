@@ -0,0 +1,177 @@
+package traefik_cluster_ratelimit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const metricsPrefix = "traefik_cluster_ratelimit_"
+
+type metricDescription struct {
+	kind string
+	help string
+}
+
+// metricDescriptions are the metrics exposed in the prometheus format
+var metricDescriptions = map[string]metricDescription{
+	"adaptive_factor":           {"gauge", "Health factor the rate limit is scaled with, in adaptive mode."},
+	"adaptive_error_ratio":      {"gauge", "Share of the upstream responses that were 5xx, during the last adaptive interval."},
+	"adaptive_latency_seconds":  {"gauge", "Upstream latency percentile, during the last adaptive interval."},
+	"decisions_total":           {"counter", "Number of rate limit decisions, in optimistic mode."},
+	"deny_cache_hits_total":     {"counter", "Number of requests rejected from the local deny cache, without calling the backend."},
+	"fair_share_active_sources": {"gauge", "Number of sources sharing the limit, in fair-share mode."},
+	"optimistic_passes_total":   {"counter", "Number of requests let through because the decision was not taken within the latency budget."},
+	"penalty_bans_total":        {"counter", "Number of sources banned by the penalty box."},
+	"optimistic_pass_ratio":     {"gauge", "Share of the decisions that were optimistic passes."},
+}
+
+// Metrics holds the metrics of a middleware
+type Metrics struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	gauges   map[string]float64
+}
+
+// the metrics of all the middlewares, by middleware name. They are kept across
+// configuration reloads, so that the counters don't go back to 0
+var (
+	allMetricsMu sync.Mutex
+	allMetrics   = map[string]*Metrics{}
+)
+
+// getMetrics returns the metrics of a middleware
+func getMetrics(name string) *Metrics {
+	allMetricsMu.Lock()
+	defer allMetricsMu.Unlock()
+
+	if m, ok := allMetrics[name]; ok {
+		return m
+	}
+	m := &Metrics{
+		counters: map[string]int64{},
+		gauges:   map[string]float64{},
+	}
+	allMetrics[name] = m
+	return m
+}
+
+// Add increments a counter
+func (m *Metrics) Add(metric string, delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counters[metric] += delta
+}
+
+// Set sets the value of a gauge
+func (m *Metrics) Set(metric string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.gauges[metric] = value
+}
+
+// Counter returns the value of a counter
+func (m *Metrics) Counter(metric string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.counters[metric]
+}
+
+// Gauge returns the value of a gauge
+func (m *Metrics) Gauge(metric string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.gauges[metric]
+}
+
+// the metrics listeners, by listen address
+var (
+	metricsServersMu sync.Mutex
+	metricsServers   = map[string]bool{}
+)
+
+// startMetricsServer exposes the metrics of all the middlewares on
+// http://<listenAddress>/metrics, unless it is already done
+func startMetricsServer(listenAddress string) error {
+	metricsServersMu.Lock()
+	defer metricsServersMu.Unlock()
+
+	if metricsServers[listenAddress] {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return fmt.Errorf("unable to listen for metrics on %s: %v", listenAddress, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	go http.Serve(listener, mux)
+
+	metricsServers[listenAddress] = true
+	return nil
+}
+
+func handleMetrics(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	rw.Write([]byte(formatMetrics()))
+}
+
+// formatMetrics returns all the metrics in the prometheus text format
+func formatMetrics() string {
+	allMetricsMu.Lock()
+	names := make([]string, 0, len(allMetrics))
+	for name := range allMetrics {
+		names = append(names, name)
+	}
+	metrics := make([]*Metrics, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		metrics[i] = allMetrics[name]
+	}
+	allMetricsMu.Unlock()
+
+	metricNames := make([]string, 0, len(metricDescriptions))
+	for metric := range metricDescriptions {
+		metricNames = append(metricNames, metric)
+	}
+	sort.Strings(metricNames)
+
+	var sb strings.Builder
+	for _, metric := range metricNames {
+		desc := metricDescriptions[metric]
+		lines := make([]string, 0, len(names))
+		for i, name := range names {
+			m := metrics[i]
+			m.mu.Lock()
+			var value string
+			if desc.kind == "counter" {
+				if v, ok := m.counters[metric]; ok {
+					value = fmt.Sprintf("%d", v)
+				}
+			} else if v, ok := m.gauges[metric]; ok {
+				value = fmt.Sprintf("%g", v)
+			}
+			m.mu.Unlock()
+			if value != "" {
+				lines = append(lines, fmt.Sprintf("%s%s{middleware=%q} %s\n", metricsPrefix, metric, name, value))
+			}
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("# HELP %s%s %s\n", metricsPrefix, metric, desc.help))
+		sb.WriteString(fmt.Sprintf("# TYPE %s%s %s\n", metricsPrefix, metric, desc.kind))
+		for _, line := range lines {
+			sb.WriteString(line)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,93 @@
+package traefik_cluster_ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// the maximum number of backend calls in flight, beyond which the requests
+// are let through without calling the backend
+const optimisticMaxInFlight = 1000
+
+type allowNResult struct {
+	res *Result
+	err error
+}
+
+// OptimisticLimiter wraps a RateLimiter with a latency budget: when the
+// decision is not taken in time, the request is let through, while the call
+// completes in the background, so that the usage is still recorded and the
+// next requests are throttled correctly.
+type OptimisticLimiter struct {
+	limiter RateLimiter
+	budget  time.Duration
+	metrics *Metrics
+	// one element per backend call in flight
+	inFlight chan struct{}
+}
+
+// NewOptimisticLimiter returns a new OptimisticLimiter.
+func NewOptimisticLimiter(limiter RateLimiter, budget time.Duration, metrics *Metrics) *OptimisticLimiter {
+	return &OptimisticLimiter{
+		limiter:  limiter,
+		budget:   budget,
+		metrics:  metrics,
+		inFlight: make(chan struct{}, optimisticMaxInFlight),
+	}
+}
+
+// AllowN reports whether n events may happen at time now, or lets them
+// happen if the decision takes longer than the latency budget.
+func (l *OptimisticLimiter) AllowN(key string, limit Limit, n int) (*Result, error) {
+	select {
+	case l.inFlight <- struct{}{}:
+	default:
+		// the backend is too slow to keep up: don't pile up more calls
+		return l.pass(limit, n), nil
+	}
+
+	// buffered, so that the background call never blocks once we gave up
+	done := make(chan allowNResult, 1)
+	go func() {
+		defer func() { <-l.inFlight }()
+		res, err := l.limiter.AllowN(key, limit, n)
+		done <- allowNResult{res: res, err: err}
+	}()
+
+	timer := time.NewTimer(l.budget)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		l.record(false)
+		return r.res, r.err
+	case <-timer.C:
+		return l.pass(limit, n), nil
+	}
+}
+
+// pass lets the events happen without a decision
+func (l *OptimisticLimiter) pass(limit Limit, n int) *Result {
+	l.record(true)
+	return &Result{
+		Limit:      limit,
+		Allowed:    n,
+		Remaining:  0,
+		RetryAfter: -1,
+		ResetAfter: 0,
+	}
+}
+
+func (l *OptimisticLimiter) record(optimistic bool) {
+	l.metrics.Add("decisions_total", 1)
+	if optimistic {
+		l.metrics.Add("optimistic_passes_total", 1)
+	}
+	l.metrics.Set("optimistic_pass_ratio",
+		float64(l.metrics.Counter("optimistic_passes_total"))/float64(l.metrics.Counter("decisions_total")))
+}
+
+// Reset gets a key and reset all limitations and previous usages
+func (l *OptimisticLimiter) Reset(ctx context.Context, key string) error {
+	return l.limiter.Reset(ctx, key)
+}
@@ -0,0 +1,94 @@
+package traefik_cluster_ratelimit
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowLimiter denies everything, after a delay
+type slowLimiter struct {
+	delay time.Duration
+	calls int64
+}
+
+func (l *slowLimiter) AllowN(key string, limit Limit, n int) (*Result, error) {
+	time.Sleep(l.delay)
+	atomic.AddInt64(&l.calls, 1)
+	return &Result{Limit: limit, Allowed: 0, RetryAfter: time.Second}, nil
+}
+
+func (l *slowLimiter) Reset(ctx context.Context, key string) error {
+	return nil
+}
+
+// blockedLimiter allows everything, once unblocked
+type blockedLimiter struct {
+	unblock chan struct{}
+	calls   int64
+}
+
+func (l *blockedLimiter) AllowN(key string, limit Limit, n int) (*Result, error) {
+	atomic.AddInt64(&l.calls, 1)
+	<-l.unblock
+	return &Result{Limit: limit, Allowed: n}, nil
+}
+
+func (l *blockedLimiter) Reset(ctx context.Context, key string) error {
+	return nil
+}
+
+func TestOptimisticLimiter(t *testing.T) {
+	t.Run("decision within the budget is enforced", func(t *testing.T) {
+		metrics := &Metrics{counters: map[string]int64{}, gauges: map[string]float64{}}
+		limiter := NewOptimisticLimiter(&slowLimiter{}, 100*time.Millisecond, metrics)
+
+		res, err := limiter.AllowN("1.2.3.4", PerSecond(10), 1)
+		require.NoError(t, err)
+		assert.Equal(t, 0, res.Allowed)
+		assert.Equal(t, int64(1), metrics.Counter("decisions_total"))
+		assert.Equal(t, int64(0), metrics.Counter("optimistic_passes_total"))
+		assert.Equal(t, 0.0, metrics.Gauge("optimistic_pass_ratio"))
+	})
+
+	t.Run("slow decision lets the request through and completes in the background", func(t *testing.T) {
+		metrics := &Metrics{counters: map[string]int64{}, gauges: map[string]float64{}}
+		slow := &slowLimiter{delay: 50 * time.Millisecond}
+		limiter := NewOptimisticLimiter(slow, time.Millisecond, metrics)
+
+		res, err := limiter.AllowN("1.2.3.4", PerSecond(10), 1)
+		require.NoError(t, err)
+		assert.Equal(t, 1, res.Allowed)
+		assert.Equal(t, int64(1), metrics.Counter("optimistic_passes_total"))
+		assert.Equal(t, 1.0, metrics.Gauge("optimistic_pass_ratio"))
+
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt64(&slow.calls) == 1
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("the calls in flight are bounded", func(t *testing.T) {
+		metrics := &Metrics{counters: map[string]int64{}, gauges: map[string]float64{}}
+		blocked := &blockedLimiter{unblock: make(chan struct{})}
+		limiter := NewOptimisticLimiter(blocked, time.Microsecond, metrics)
+
+		for i := 0; i < optimisticMaxInFlight+10; i++ {
+			res, err := limiter.AllowN("1.2.3.4", PerSecond(10), 1)
+			require.NoError(t, err)
+			assert.Equal(t, 1, res.Allowed)
+		}
+		assert.Equal(t, optimisticMaxInFlight, len(limiter.inFlight))
+		assert.Equal(t, int64(optimisticMaxInFlight+10), metrics.Counter("optimistic_passes_total"))
+
+		// the backend was only called for the requests in flight
+		close(blocked.unblock)
+		assert.Eventually(t, func() bool {
+			return len(limiter.inFlight) == 0
+		}, time.Second, 10*time.Millisecond)
+		assert.Equal(t, int64(optimisticMaxInFlight), atomic.LoadInt64(&blocked.calls))
+	})
+}
@@ -0,0 +1,428 @@
+package traefik_cluster_ratelimit
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/nzin/traefik-cluster-ratelimit/internal/peers"
+)
+
+// peerNodeID identifies this Traefik instance, so that it can recognize
+// itself in the peers list
+var peerNodeID = randomID()
+
+// the peer protocol listeners, by listen address. They are shared by all the
+// middlewares using the peers backend, and kept across configuration reloads
+var (
+	peerServersMu sync.Mutex
+	peerServers   = map[string]*peerServer{}
+)
+
+type peerServer struct {
+	mu          sync.Mutex
+	middlewares map[string]*peerMiddleware
+}
+
+// peerMiddleware is a middleware registered on a peer server, with its own
+// secret
+type peerMiddleware struct {
+	secret string
+	local  *LocalLimiter
+}
+
+type peerAllowRequest struct {
+	Name   string        `json:"name"`
+	Key    string        `json:"key"`
+	Rate   int64         `json:"rate"`
+	Burst  int64         `json:"burst"`
+	Period time.Duration `json:"period"`
+	N      int           `json:"n"`
+}
+
+type peerAllowResponse struct {
+	Allowed    int           `json:"allowed"`
+	Remaining  int           `json:"remaining"`
+	RetryAfter time.Duration `json:"retryAfter"`
+	ResetAfter time.Duration `json:"resetAfter"`
+}
+
+// getPeerServer returns the listener of the given address, starting it if needed
+func getPeerServer(listenAddress string) (*peerServer, error) {
+	peerServersMu.Lock()
+	defer peerServersMu.Unlock()
+
+	if s, ok := peerServers[listenAddress]; ok {
+		return s, nil
+	}
+
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen for peers on %s: %v", listenAddress, err)
+	}
+
+	s := &peerServer{
+		middlewares: map[string]*peerMiddleware{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", s.handlePing)
+	mux.HandleFunc("/allow", s.handleAllow)
+	mux.HandleFunc("/reset", s.handleReset)
+	go http.Serve(listener, mux)
+
+	peerServers[listenAddress] = s
+	return s, nil
+}
+
+// register returns the local state of a middleware, keeping the previous
+// one if the middleware is re-created by a configuration reload
+func (s *peerServer) register(name, secret string) *LocalLimiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m, ok := s.middlewares[name]; ok {
+		m.secret = secret
+		return m.local
+	}
+	m := &peerMiddleware{
+		secret: secret,
+		local:  NewLocalLimiter(),
+	}
+	s.middlewares[name] = m
+	return m.local
+}
+
+// middleware returns the local state of a middleware, if the request carries
+// its secret. Otherwise, it answers the request with an error, and returns nil
+func (s *peerServer) middleware(rw http.ResponseWriter, req *http.Request, name string) *LocalLimiter {
+	s.mu.Lock()
+	m, ok := s.middlewares[name]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(rw, fmt.Sprintf("unknown middleware %q", name), http.StatusNotFound)
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get("X-Peer-Secret")), []byte(m.secret)) != 1 {
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil
+	}
+	return m.local
+}
+
+func (s *peerServer) handlePing(rw http.ResponseWriter, req *http.Request) {
+	if s.middleware(rw, req, req.URL.Query().Get("name")) == nil {
+		return
+	}
+	rw.Write([]byte(peerNodeID))
+}
+
+// decodePeerRequest reads the body of an /allow or /reset call, and returns
+// the local state of the middleware it targets
+func (s *peerServer) decodePeerRequest(rw http.ResponseWriter, req *http.Request) (*peerAllowRequest, *LocalLimiter) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return nil, nil
+	}
+
+	var r peerAllowRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return nil, nil
+	}
+
+	local := s.middleware(rw, req, r.Name)
+	if local == nil {
+		return nil, nil
+	}
+	return &r, local
+}
+
+func (s *peerServer) handleAllow(rw http.ResponseWriter, req *http.Request) {
+	r, local := s.decodePeerRequest(rw, req)
+	if r == nil {
+		return
+	}
+	if r.Rate <= 0 || r.Burst <= 0 || r.Period <= 0 || r.N <= 0 {
+		http.Error(rw, "invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	res, _ := local.AllowN(r.Key, Limit{Rate: r.Rate, Burst: r.Burst, Period: r.Period}, r.N)
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(&peerAllowResponse{
+		Allowed:    res.Allowed,
+		Remaining:  res.Remaining,
+		RetryAfter: res.RetryAfter,
+		ResetAfter: res.ResetAfter,
+	})
+}
+
+func (s *peerServer) handleReset(rw http.ResponseWriter, req *http.Request) {
+	r, local := s.decodePeerRequest(rw, req)
+	if r == nil {
+		return
+	}
+	local.Reset(req.Context(), r.Key)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// PeerLimiter shares the rate limit state between Traefik instances without
+// any external storage: each key is owned by one instance (using consistent
+// hashing), and the other instances forward their decisions to the owner.
+// When the owner is unreachable, the decision is taken locally.
+type PeerLimiter struct {
+	name     string
+	secret   string
+	local    *LocalLimiter
+	resolver peers.Resolver
+	client   *http.Client
+
+	mu   sync.RWMutex
+	ring *peers.Ring
+	self string
+}
+
+// NewPeerLimiter returns a new PeerLimiter, listening for the other peers on
+// listenAddress, and refreshing the list of (alive) peers every refresh period
+// until ctx is done.
+func NewPeerLimiter(
+	ctx context.Context,
+	name string,
+	listenAddress string,
+	secret string,
+	resolver peers.Resolver,
+	timeout time.Duration,
+	refresh time.Duration,
+) (*PeerLimiter, error) {
+	server, err := getPeerServer(listenAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &PeerLimiter{
+		name:     name,
+		secret:   secret,
+		local:    server.register(name, secret),
+		resolver: resolver,
+		client:   &http.Client{Timeout: timeout},
+	}
+
+	go func() {
+		ticker := time.NewTicker(refresh)
+		defer ticker.Stop()
+		for {
+			l.refresh()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return l, nil
+}
+
+// refresh rebuilds the ring with the peers answering to a ping
+func (l *PeerLimiter) refresh() {
+	addrs, err := l.resolver.Resolve()
+	if err != nil {
+		// keep the current ring until the resolution works again
+		return
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	alive := make([]string, 0, len(addrs))
+	self := ""
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			id, err := l.ping(addr)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			alive = append(alive, addr)
+			if id == peerNodeID {
+				self = addr
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	ring := peers.NewRing(alive, peers.DEFAULT_REPLICAS)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ring = ring
+	l.self = self
+}
+
+func (l *PeerLimiter) ping(addr string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/ping?name="+url.QueryEscape(l.name), nil)
+	if err != nil {
+		return "", err
+	}
+	body, err := l.call(req)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// peerStatusError is the error answered by a reachable peer
+type peerStatusError struct {
+	host   string
+	status int
+	body   []byte
+}
+
+func (e *peerStatusError) Error() string {
+	return fmt.Sprintf("peer %s answered %d: %s", e.host, e.status, e.body)
+}
+
+// markDown removes an unreachable peer from the ring, so that its keys move
+// to another peer until the next refresh
+func (l *PeerLimiter) markDown(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.ring == nil {
+		return
+	}
+	members := make([]string, 0, len(l.ring.Members()))
+	for _, member := range l.ring.Members() {
+		if member != addr {
+			members = append(members, member)
+		}
+	}
+	l.ring = peers.NewRing(members, peers.DEFAULT_REPLICAS)
+}
+
+// owner returns the address of the peer owning the key, or "" if the key is
+// owned by this instance
+func (l *PeerLimiter) owner(key string) string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.ring == nil {
+		return ""
+	}
+	owner := l.ring.Get(key)
+	if owner == l.self {
+		return ""
+	}
+	return owner
+}
+
+// AllowN reports whether n events may happen at time now.
+func (l *PeerLimiter) AllowN(key string, limit Limit, n int) (*Result, error) {
+	owner := l.owner(key)
+	if owner == "" {
+		return l.local.AllowN(key, limit, n)
+	}
+
+	res, err := l.forwardAllowN(owner, key, limit, n)
+	if err != nil {
+		// a peer answering with an error is still up
+		if _, ok := err.(*peerStatusError); !ok {
+			l.markDown(owner)
+		}
+		return l.local.AllowN(key, limit, n)
+	}
+	return res, nil
+}
+
+func (l *PeerLimiter) forwardAllowN(owner string, key string, limit Limit, n int) (*Result, error) {
+	body, err := json.Marshal(&peerAllowRequest{
+		Name:   l.name,
+		Key:    key,
+		Rate:   limit.Rate,
+		Burst:  limit.Burst,
+		Period: limit.Period,
+		N:      n,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+owner+"/allow", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	body, err = l.call(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var r peerAllowResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("invalid peer response: %v", err)
+	}
+	return &Result{
+		Limit:      limit,
+		Allowed:    r.Allowed,
+		Remaining:  r.Remaining,
+		RetryAfter: r.RetryAfter,
+		ResetAfter: r.ResetAfter,
+	}, nil
+}
+
+// call sends a request to a peer, and returns the response body
+func (l *PeerLimiter) call(req *http.Request) ([]byte, error) {
+	req.Header.Set("X-Peer-Secret", l.secret)
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, &peerStatusError{host: req.URL.Host, status: resp.StatusCode, body: body}
+	}
+	return body, nil
+}
+
+// Reset gets a key and reset all limitations and previous usages
+func (l *PeerLimiter) Reset(ctx context.Context, key string) error {
+	// the local state may have been used as a fallback
+	l.local.Reset(ctx, key)
+
+	owner := l.owner(key)
+	if owner == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(&peerAllowRequest{
+		Name: l.name,
+		Key:  key,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+owner+"/reset", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	_, err = l.call(req)
+	return err
+}
@@ -0,0 +1,165 @@
+package traefik_cluster_ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nzin/traefik-cluster-ratelimit/internal/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerLimiter(t *testing.T) {
+	// a fake peer, denying everything
+	var forwarded, failing int64
+	remote := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ping":
+			rw.Write([]byte("remote-peer"))
+		case "/allow":
+			assert.Equal(t, "secret", req.Header.Get("X-Peer-Secret"))
+			if atomic.LoadInt64(&failing) == 1 {
+				http.Error(rw, "unknown middleware", http.StatusNotFound)
+				return
+			}
+			atomic.AddInt64(&forwarded, 1)
+			json.NewEncoder(rw).Encode(&peerAllowResponse{Allowed: 0, RetryAfter: time.Second})
+		}
+	}))
+	remoteAddr := strings.TrimPrefix(remote.URL, "http://")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	localAddr := listener.Addr().String()
+	listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	limiter, err := NewPeerLimiter(
+		ctx,
+		"test",
+		localAddr,
+		"secret",
+		&peers.StaticResolver{Peers: []string{localAddr, remoteAddr}},
+		100*time.Millisecond,
+		time.Hour,
+	)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		limiter.mu.RLock()
+		defer limiter.mu.RUnlock()
+		return limiter.ring != nil && len(limiter.ring.Members()) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, localAddr, limiter.self)
+
+	localKey, remoteKey := "", ""
+	for i := 0; localKey == "" || remoteKey == ""; i++ {
+		key := fmt.Sprintf("10.0.0.%d", i)
+		if limiter.owner(key) == "" {
+			localKey = key
+		} else {
+			remoteKey = key
+		}
+	}
+	limit := Limit{Rate: 10, Burst: 10, Period: time.Second}
+
+	t.Run("keys owned by this instance are decided locally", func(t *testing.T) {
+		res, err := limiter.AllowN(localKey, limit, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 1, res.Allowed)
+		assert.Equal(t, int64(0), atomic.LoadInt64(&forwarded))
+	})
+
+	t.Run("keys owned by another instance are forwarded", func(t *testing.T) {
+		res, err := limiter.AllowN(remoteKey, limit, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 0, res.Allowed)
+		assert.Equal(t, time.Second, res.RetryAfter)
+		assert.Equal(t, int64(1), atomic.LoadInt64(&forwarded))
+	})
+
+	t.Run("the peer protocol is protected by the secret", func(t *testing.T) {
+		resp, err := http.Get("http://" + localAddr + "/ping?name=test")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("each middleware has its own secret", func(t *testing.T) {
+		other, err := NewPeerLimiter(
+			ctx,
+			"other",
+			localAddr,
+			"other-secret",
+			&peers.StaticResolver{Peers: []string{localAddr}},
+			100*time.Millisecond,
+			time.Hour,
+		)
+		require.NoError(t, err)
+
+		// both middlewares still talk to this instance
+		for _, l := range []*PeerLimiter{limiter, other} {
+			id, err := l.ping(localAddr)
+			require.NoError(t, err)
+			assert.Equal(t, peerNodeID, id)
+		}
+
+		// but not with the secret of the other one
+		req, err := http.NewRequest(http.MethodGet, "http://"+localAddr+"/ping?name=other", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Peer-Secret", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("invalid limits are rejected", func(t *testing.T) {
+		for _, r := range []peerAllowRequest{
+			{Name: "test", Key: "k", Rate: 10, Burst: 0, Period: time.Second, N: 1},
+			{Name: "test", Key: "k", Rate: 10, Burst: 10, Period: time.Second, N: 0},
+			{Name: "test", Key: "k", Rate: 10, Burst: 10, Period: time.Second, N: -5},
+		} {
+			body, err := json.Marshal(&r)
+			require.NoError(t, err)
+			req, err := http.NewRequest(http.MethodPost, "http://"+localAddr+"/allow", strings.NewReader(string(body)))
+			require.NoError(t, err)
+			req.Header.Set("X-Peer-Secret", "secret")
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("a peer answering with an error stays in the ring", func(t *testing.T) {
+		atomic.StoreInt64(&failing, 1)
+		defer atomic.StoreInt64(&failing, 0)
+
+		res, err := limiter.AllowN(remoteKey, limit, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 1, res.Allowed)
+		assert.Equal(t, remoteAddr, limiter.owner(remoteKey))
+	})
+
+	t.Run("fallback to a local decision when the owner is unreachable", func(t *testing.T) {
+		remote.Close()
+
+		res, err := limiter.AllowN(remoteKey, limit, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 1, res.Allowed)
+
+		// the key moved to the remaining peer
+		assert.Equal(t, "", limiter.owner(remoteKey))
+	})
+}
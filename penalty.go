@@ -0,0 +1,44 @@
+package traefik_cluster_ratelimit
+
+import (
+	"context"
+)
+
+// PenaltyLimiter is a Limiter with a penalty box: the keys rejected too often
+// are banned, for longer and longer if they keep being rejected after their ban
+type PenaltyLimiter struct {
+	limiter *Limiter
+	penalty Penalty
+	metrics *Metrics
+}
+
+// NewPenaltyLimiter returns a new PenaltyLimiter. The limiter must use the
+// GCRA algorithm
+func NewPenaltyLimiter(limiter *Limiter, penalty Penalty, metrics *Metrics) *PenaltyLimiter {
+	return &PenaltyLimiter{
+		limiter: limiter,
+		penalty: penalty,
+		metrics: metrics,
+	}
+}
+
+// AllowN reports whether n events may happen at time now.
+func (l *PenaltyLimiter) AllowN(key string, limit Limit, n int) (*Result, error) {
+	res, banned, err := l.limiter.AllowNWithPenalty(key, limit, n, l.penalty)
+	if err != nil {
+		return nil, err
+	}
+	if banned {
+		l.metrics.Add("penalty_bans_total", 1)
+	}
+	return res, nil
+}
+
+// Reset gets a key and reset all limitations and previous usages,
+// including its ban
+func (l *PenaltyLimiter) Reset(ctx context.Context, key string) error {
+	if err := l.limiter.ResetPenalty(key); err != nil {
+		return err
+	}
+	return l.limiter.Reset(ctx, key)
+}
@@ -0,0 +1,90 @@
+package traefik_cluster_ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPenaltyLimiter(t *testing.T) {
+	redisLimiter, server := newTestLimiter(t, AlgorithmGCRA)
+	metrics := &Metrics{counters: map[string]int64{}, gauges: map[string]float64{}}
+	limiter := NewPenaltyLimiter(redisLimiter, Penalty{
+		Threshold: 2,
+		Window:    time.Minute,
+		Ban:       10 * time.Second,
+		MaxBan:    15 * time.Second,
+	}, metrics)
+	limit := Limit{Rate: 1, Burst: 1, Period: time.Hour}
+
+	// rejected more than twice: banned
+	ban := func(duration time.Duration) {
+		for i := 0; i < 2; i++ {
+			res, err := limiter.AllowN("1.2.3.4", limit, 1)
+			require.NoError(t, err)
+			assert.Equal(t, 0, res.Allowed)
+			assert.Greater(t, res.RetryAfter, 50*time.Minute)
+		}
+		res, err := limiter.AllowN("1.2.3.4", limit, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 0, res.Allowed)
+		assert.Equal(t, duration, res.RetryAfter)
+	}
+
+	res, err := limiter.AllowN("1.2.3.4", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Allowed)
+	ban(10 * time.Second)
+	assert.Equal(t, int64(1), metrics.Counter("penalty_bans_total"))
+
+	// banned, whatever the limit says
+	res, err = limiter.AllowN("1.2.3.4", Limit{Rate: 100, Burst: 100, Period: time.Second}, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Allowed)
+	assert.Equal(t, 10*time.Second, res.RetryAfter)
+	assert.Equal(t, int64(1), metrics.Counter("penalty_bans_total"))
+
+	// the ban doubles on recurrence, up to the maximum
+	server.FastForward(11 * time.Second)
+	ban(15 * time.Second)
+	assert.Equal(t, int64(2), metrics.Counter("penalty_bans_total"))
+
+	// reset lifts the ban
+	require.NoError(t, limiter.Reset(context.Background(), "1.2.3.4"))
+	res, err = limiter.AllowN("1.2.3.4", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Allowed)
+}
+
+func TestPenaltyRetryAfter(t *testing.T) {
+	rl, _ := newTestMiddleware(t, &Config{
+		Average:          1,
+		Burst:            1,
+		Period:           3600,
+		PenaltyThreshold: 1,
+		PenaltyDuration:  10,
+	}, func(rw http.ResponseWriter, req *http.Request) {})
+
+	codes := []int{}
+	var rw *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		rw = httptest.NewRecorder()
+		rl.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+		codes = append(codes, rw.Code)
+	}
+	assert.Equal(t, []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}, codes)
+	// exactly the ban, not one more second
+	assert.Equal(t, "10", rw.Header().Get("retry-after"))
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	assert.Equal(t, "10", retryAfterHeader(10*time.Second))
+	assert.Equal(t, "11", retryAfterHeader(10*time.Second+time.Millisecond))
+	assert.Equal(t, "1", retryAfterHeader(300*time.Millisecond))
+	assert.Equal(t, "1", retryAfterHeader(0))
+}
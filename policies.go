@@ -0,0 +1,59 @@
+package traefik_cluster_ratelimit
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nzin/traefik-cluster-ratelimit/internal/utils"
+)
+
+// PolicyConfig is one of the named policies of Config.Policies
+type PolicyConfig struct {
+	// Name identifies the policy, in the X-RateLimit-Policy header of the rejections
+	Name string `json:"name" yaml:"name"`
+	// SourceCriterion defines how the requests are grouped for this policy, like the
+	// SourceCriterion of the middleware. "global: true" shares the limit between all the requests
+	SourceCriterion *utils.SourceCriterion `json:"sourceCriterion,omitempty" yaml:"sourceCriterion,omitempty"`
+	// Average, Burst and Period are the limit of the policy, like in Config.Limits
+	Average int64 `json:"average" yaml:"average"`
+	Burst   int64 `json:"burst" yaml:"burst"`
+	Period  int64 `json:"period,omitempty" yaml:"period,omitempty"`
+}
+
+// newPolicies validates the configured list of policies
+func newPolicies(configs []PolicyConfig) ([]policy, error) {
+	policies := make([]policy, 0, len(configs))
+	names := map[string]bool{}
+	for i, config := range configs {
+		if config.Name == "" {
+			return nil, fmt.Errorf("policies[%d]: name is mandatory", i)
+		}
+		// the name scopes the keys of the policy
+		if strings.Contains(config.Name, ":") {
+			return nil, fmt.Errorf("policies[%d]: name %q cannot contain a colon", i, config.Name)
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("policies[%d]: duplicated name %q", i, config.Name)
+		}
+		names[config.Name] = true
+
+		limit, err := newLimit(LimitConfig{
+			Average: config.Average,
+			Burst:   config.Burst,
+			Period:  config.Period,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %v", config.Name, err)
+		}
+		sourceMatcher, err := utils.GetSourceExtractor(config.SourceCriterion)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %v", config.Name, err)
+		}
+		policies = append(policies, policy{
+			name:          config.Name,
+			limit:         limit,
+			sourceMatcher: sourceMatcher,
+		})
+	}
+	return policies, nil
+}
@@ -0,0 +1,67 @@
+package traefik_cluster_ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nzin/traefik-cluster-ratelimit/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPolicies(t *testing.T) {
+	for _, configs := range [][]PolicyConfig{
+		{{Average: 10, Burst: 10}},
+		{{Name: "a", Average: 10, Burst: 10}, {Name: "a", Average: 20, Burst: 20}},
+		{{Name: "a", Average: 10}},
+		{{Name: "a:b", Average: 10, Burst: 10}},
+		{{Name: "a", Average: 10, Burst: 10, SourceCriterion: &utils.SourceCriterion{Global: true, RequestHost: true}}},
+	} {
+		_, err := newPolicies(configs)
+		assert.Error(t, err, configs)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	rl, server := newTestMiddleware(t, &Config{
+		Policies: []PolicyConfig{
+			{Name: "per-ip", Average: 2, Burst: 2, Period: 60},
+			{
+				Name:            "per-api-key",
+				SourceCriterion: &utils.SourceCriterion{RequestHeaderName: "X-Api-Key"},
+				Average:         3,
+				Burst:           3,
+				Period:          60,
+			},
+		},
+	}, func(rw http.ResponseWriter, req *http.Request) {})
+
+	serve := func(ip, apiKey string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set("X-Api-Key", apiKey)
+		rl.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, http.StatusOK, serve("1.1.1.1", "key").Code)
+	assert.Equal(t, http.StatusOK, serve("1.1.1.1", "key").Code)
+	rw := serve("1.1.1.1", "key")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "per-ip", rw.Header().Get("X-RateLimit-Policy"))
+
+	// the rejected request was not counted by the per API key policy
+	assert.Equal(t, http.StatusOK, serve("2.2.2.2", "key").Code)
+	rw = serve("3.3.3.3", "key")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "per-api-key", rw.Header().Get("X-RateLimit-Policy"))
+	// the keys are scoped by the name of the policy
+	assert.True(t, server.Exists("policy_"+t.Name()+"per-api-key:key"))
+	assert.True(t, server.Exists("policy_"+t.Name()+"per-ip:1.1.1.1"))
+
+	// the other keys have their own limit
+	rw = serve("3.3.3.3", "other")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Empty(t, rw.Header().Get("X-RateLimit-Policy"))
+}
@@ -0,0 +1,94 @@
+package traefik_cluster_ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// the key of the bucket shared by the priority classes, in the Limiter
+// returned by Limiter.Priority
+const priorityBucket = ""
+
+// PriorityClass is one of Config.PriorityClasses. A request belongs to the
+// first class it matches: all the criteria set must match
+type PriorityClass struct {
+	// Name identifies the class
+	Name string `json:"name" yaml:"name"`
+	// Reserve is the number of tokens of the shared bucket this class cannot use,
+	// kept for the higher classes
+	Reserve int64 `json:"reserve,omitempty" yaml:"reserve,omitempty"`
+	// HeaderName and HeaderValue match the requests having this header value.
+	// Without HeaderValue, the header only needs to be present
+	HeaderName  string `json:"headerName,omitempty" yaml:"headerName,omitempty"`
+	HeaderValue string `json:"headerValue,omitempty" yaml:"headerValue,omitempty"`
+	// Sources match the requests whose source (see SourceCriterion) is one of them
+	Sources []string `json:"sources,omitempty" yaml:"sources,omitempty"`
+	// PathPrefix matches the requests whose path starts with it
+	PathPrefix string `json:"pathPrefix,omitempty" yaml:"pathPrefix,omitempty"`
+}
+
+func (c *PriorityClass) match(req *http.Request, source string) bool {
+	if c.HeaderName != "" {
+		values, ok := req.Header[http.CanonicalHeaderKey(c.HeaderName)]
+		if !ok || c.HeaderValue != "" && values[0] != c.HeaderValue {
+			return false
+		}
+	}
+	if len(c.Sources) > 0 {
+		found := false
+		for _, s := range c.Sources {
+			if s == source {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, c.PathPrefix) {
+		return false
+	}
+	return true
+}
+
+// validatePriorityClasses checks the classes, from the highest priority to the
+// lowest one: the reserves must grow, and stay below the burst
+func validatePriorityClasses(classes []PriorityClass, burst int64) error {
+	reserve := int64(0)
+	for i, class := range classes {
+		if class.Name == "" {
+			return fmt.Errorf("priorityClasses[%d]: name is mandatory", i)
+		}
+		if class.Reserve < reserve {
+			return fmt.Errorf("priority class %s: reserve must be >= the reserve of the higher classes", class.Name)
+		}
+		if class.Reserve >= burst {
+			return fmt.Errorf("priority class %s: reserve must be < burst", class.Name)
+		}
+		reserve = class.Reserve
+	}
+	return nil
+}
+
+// priorityClass returns the class of the request. The requests matching no
+// class belong to the last (lowest) one
+func (rl *ClusterRateLimit) priorityClass(req *http.Request, source string) *PriorityClass {
+	for i := range rl.priorityClasses {
+		if rl.priorityClasses[i].match(req, source) {
+			return &rl.priorityClasses[i]
+		}
+	}
+	return &rl.priorityClasses[len(rl.priorityClasses)-1]
+}
+
+// bucket returns the key of the bucket of the source: with priority classes,
+// all the requests share the same bucket, so that the reserves of the higher
+// classes are kept from all the sources
+func (rl *ClusterRateLimit) bucket(source string) string {
+	if len(rl.priorityClasses) > 0 {
+		return priorityBucket
+	}
+	return source
+}
@@ -0,0 +1,97 @@
+package traefik_cluster_ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatePriorityClasses(t *testing.T) {
+	classes := []PriorityClass{
+		{Name: "health", PathPrefix: "/health"},
+		{Name: "paid", HeaderName: "X-Plan", HeaderValue: "paid", Reserve: 2},
+		{Name: "anonymous", Reserve: 6},
+	}
+	require.NoError(t, validatePriorityClasses(classes, 10))
+	assert.Error(t, validatePriorityClasses(classes, 6))
+	assert.Error(t, validatePriorityClasses([]PriorityClass{{Name: "a", Reserve: 2}, {Name: "b", Reserve: 1}}, 10))
+}
+
+func TestPriorityClasses(t *testing.T) {
+	rl, server := newTestMiddleware(t, &Config{
+		Average: 10,
+		Burst:   10,
+		Period:  60,
+		PriorityClasses: []PriorityClass{
+			{Name: "health", PathPrefix: "/health"},
+			{Name: "partner", Sources: []string{"10.0.0.1"}, Reserve: 2},
+			{Name: "paid", HeaderName: "X-Plan", HeaderValue: "paid", Reserve: 2},
+			{Name: "anonymous", Reserve: 6},
+		},
+	}, func(rw http.ResponseWriter, req *http.Request) {})
+	server.SetTime(time.Now())
+
+	serve := func(ip, path, plan string) int {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = ip + ":1234"
+		if plan != "" {
+			req.Header.Set("X-Plan", plan)
+		}
+		rl.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	// the anonymous traffic of all the sources stops at the reserve of 6 tokens
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, http.StatusOK, serve("1.1.1.1", "/", ""), i)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, serve("1.1.1.1", "/", ""))
+	assert.Equal(t, http.StatusTooManyRequests, serve("2.2.2.2", "/", ""))
+	// the paid customers and the partner can use 4 more tokens
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, serve("3.3.3.3", "/", "paid"), i)
+	}
+	assert.Equal(t, http.StatusOK, serve("10.0.0.1", "/", ""))
+	assert.Equal(t, http.StatusTooManyRequests, serve("3.3.3.3", "/", "paid"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("10.0.0.1", "/", ""))
+	// and the health checks the last ones
+	assert.Equal(t, http.StatusOK, serve("4.4.4.4", "/health", ""))
+	assert.Equal(t, http.StatusOK, serve("5.5.5.5", "/health", ""))
+	assert.Equal(t, http.StatusTooManyRequests, serve("4.4.4.4", "/health", ""))
+}
+
+func TestLimiterReserve(t *testing.T) {
+	limiter, server := newTestLimiter(t, AlgorithmGCRA)
+	limit := Limit{Rate: 10, Burst: 10, Period: time.Minute, Reserve: 6}
+	sources := limiter
+	limiter = limiter.Priority()
+
+	// the reserve is kept out of the overridden burst too
+	require.NoError(t, limiter.SetOverride(priorityBucket, Limit{Rate: 20, Burst: 20, Period: time.Minute}, 0))
+	for i := 0; i < 14; i++ {
+		res, err := limiter.AllowN(priorityBucket, limit, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 1, res.Allowed, i)
+	}
+	res, err := limiter.AllowN(priorityBucket, limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Allowed)
+
+	limit.Reserve = 0
+	res, err = limiter.AllowN(priorityBucket, limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Allowed)
+
+	// apart from the buckets of the sources, and from their overrides
+	assert.True(t, server.Exists("priority_test"))
+	assert.True(t, server.Exists("priority_override:test"))
+	res, err = sources.AllowN("priority", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Allowed)
+	assert.False(t, res.Overridden)
+}
@@ -0,0 +1,132 @@
+package traefik_cluster_ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// calendar quota periods
+const (
+	QuotaHour  = "hour"
+	QuotaDay   = "day"
+	QuotaWeek  = "week"
+	QuotaMonth = "month"
+)
+
+// quotaAnchorLayout is the layout of Config.QuotaAnchor, read in the quota timezone
+const quotaAnchorLayout = "2006-01-02T15:04:05"
+
+// quota is a number of requests per calendar period
+type quota struct {
+	limiter *Limiter
+	limit   int64
+	period  string
+	// anchor is when a period starts: at its minute for hourly periods, its time
+	// for daily ones, its weekday and time for weekly ones, and its day of the
+	// month and time for monthly ones
+	anchor time.Time
+}
+
+func newQuota(limiter *Limiter, limit int64, period string, timezone string, anchor string) (*quota, error) {
+	switch period {
+	case QuotaHour, QuotaDay, QuotaWeek, QuotaMonth:
+	default:
+		return nil, fmt.Errorf("unknown quotaPeriod %q", period)
+	}
+	if limit < 1 {
+		return nil, fmt.Errorf("quota must be >=1")
+	}
+
+	location := time.UTC
+	if timezone != "" {
+		var err error
+		location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quotaTimezone: %v", err)
+		}
+	}
+	if anchor == "" {
+		// a Monday, at midnight
+		anchor = "2024-01-01T00:00:00"
+	}
+	anchorTime, err := time.ParseInLocation(quotaAnchorLayout, anchor, location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid quotaAnchor: %v", err)
+	}
+
+	return &quota{
+		limiter: limiter,
+		limit:   limit,
+		period:  period,
+		anchor:  anchorTime,
+	}, nil
+}
+
+// bounds returns the start and the end of the period containing now
+func (q *quota) bounds(now time.Time) (time.Time, time.Time) {
+	now = now.In(q.anchor.Location())
+	a := q.anchor
+	y, m, d := now.Date()
+
+	switch q.period {
+	case QuotaHour:
+		start := time.Date(y, m, d, now.Hour(), a.Minute(), a.Second(), 0, now.Location())
+		if start.After(now) {
+			start = start.Add(-time.Hour)
+		}
+		return start, start.Add(time.Hour)
+	case QuotaDay:
+		start := time.Date(y, m, d, a.Hour(), a.Minute(), a.Second(), 0, now.Location())
+		if start.After(now) {
+			d--
+			start = time.Date(y, m, d, a.Hour(), a.Minute(), a.Second(), 0, now.Location())
+		}
+		return start, time.Date(y, m, d+1, a.Hour(), a.Minute(), a.Second(), 0, now.Location())
+	case QuotaWeek:
+		d -= (int(now.Weekday()) - int(a.Weekday()) + 7) % 7
+		start := time.Date(y, m, d, a.Hour(), a.Minute(), a.Second(), 0, now.Location())
+		if start.After(now) {
+			d -= 7
+			start = time.Date(y, m, d, a.Hour(), a.Minute(), a.Second(), 0, now.Location())
+		}
+		return start, time.Date(y, m, d+7, a.Hour(), a.Minute(), a.Second(), 0, now.Location())
+	default:
+		start := q.monthStart(y, m)
+		if start.After(now) {
+			m--
+			start = q.monthStart(y, m)
+		}
+		return start, q.monthStart(y, m+1)
+	}
+}
+
+// monthStart returns the start of the monthly period of the given month. When
+// the anchor day doesn't exist in the month (like the 31st), the period starts
+// on its last day
+func (q *quota) monthStart(y int, m time.Month) time.Time {
+	a := q.anchor
+	day := a.Day()
+	// the day before the 1st of the next month
+	if last := time.Date(y, m+1, 0, 0, 0, 0, 0, a.Location()).Day(); day > last {
+		day = last
+	}
+	return time.Date(y, m, day, a.Hour(), a.Minute(), a.Second(), 0, a.Location())
+}
+
+// allowN consumes n requests of the quota of the source, if they are left
+func (q *quota) allowN(source string, n int) (*Result, error) {
+	start, end := q.bounds(time.Now())
+	return q.limiter.AllowQuota(fmt.Sprintf("%s:%d", source, start.Unix()), Limit{
+		Rate:   q.limit,
+		Burst:  q.limit,
+		Period: end.Sub(start),
+	}, n, end)
+}
+
+// setQuotaHeaders reports the state of the quota to the client
+func setQuotaHeaders(rw http.ResponseWriter, res *Result) {
+	rw.Header().Set("X-Quota-Limit", fmt.Sprintf("%d", res.Limit.Rate))
+	rw.Header().Set("X-Quota-Remaining", fmt.Sprintf("%d", res.Remaining))
+	rw.Header().Set("X-Quota-Reset", fmt.Sprintf("%d", res.ResetAt.Unix()))
+}
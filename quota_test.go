@@ -0,0 +1,119 @@
+package traefik_cluster_ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaBounds(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	require.NoError(t, err)
+
+	tests := []struct {
+		period string
+		anchor string
+		now    time.Time
+		start  time.Time
+		end    time.Time
+	}{
+		{
+			period: QuotaHour,
+			anchor: "2024-01-01T00:30:00",
+			now:    time.Date(2026, 10, 18, 10, 10, 0, 0, paris),
+			start:  time.Date(2026, 10, 18, 9, 30, 0, 0, paris),
+			end:    time.Date(2026, 10, 18, 10, 30, 0, 0, paris),
+		},
+		{
+			// the day of the daylight saving time change lasts 25 hours
+			period: QuotaDay,
+			now:    time.Date(2026, 10, 25, 10, 0, 0, 0, paris),
+			start:  time.Date(2026, 10, 25, 0, 0, 0, 0, paris),
+			end:    time.Date(2026, 10, 26, 0, 0, 0, 0, paris),
+		},
+		{
+			period: QuotaDay,
+			anchor: "2024-01-01T06:00:00",
+			now:    time.Date(2026, 10, 18, 5, 0, 0, 0, paris),
+			start:  time.Date(2026, 10, 17, 6, 0, 0, 0, paris),
+			end:    time.Date(2026, 10, 18, 6, 0, 0, 0, paris),
+		},
+		{
+			// a sunday
+			period: QuotaWeek,
+			now:    time.Date(2026, 10, 18, 10, 0, 0, 0, paris),
+			start:  time.Date(2026, 10, 12, 0, 0, 0, 0, paris),
+			end:    time.Date(2026, 10, 19, 0, 0, 0, 0, paris),
+		},
+		{
+			period: QuotaMonth,
+			now:    time.Date(2026, 10, 18, 10, 0, 0, 0, paris),
+			start:  time.Date(2026, 10, 1, 0, 0, 0, 0, paris),
+			end:    time.Date(2026, 11, 1, 0, 0, 0, 0, paris),
+		},
+		{
+			// no 31st in February
+			period: QuotaMonth,
+			anchor: "2024-01-31T00:00:00",
+			now:    time.Date(2026, 3, 10, 0, 0, 0, 0, paris),
+			start:  time.Date(2026, 2, 28, 0, 0, 0, 0, paris),
+			end:    time.Date(2026, 3, 31, 0, 0, 0, 0, paris),
+		},
+	}
+
+	for _, test := range tests {
+		q, err := newQuota(nil, 100, test.period, "Europe/Paris", test.anchor)
+		require.NoError(t, err)
+		start, end := q.bounds(test.now.UTC())
+		assert.True(t, test.start.Equal(start), "%s %s: start %s", test.period, test.now, start)
+		assert.True(t, test.end.Equal(end), "%s %s: end %s", test.period, test.now, end)
+	}
+
+	_, err = newQuota(nil, 100, "year", "", "")
+	assert.Error(t, err)
+}
+
+func TestLimiterAllowQuota(t *testing.T) {
+	limiter, server := newTestLimiter(t, AlgorithmGCRA)
+	paris, err := time.LoadLocation("Europe/Paris")
+	require.NoError(t, err)
+	q, err := newQuota(limiter, 3, QuotaDay, "Europe/Paris", "")
+	require.NoError(t, err)
+
+	// two hours before the end of the day of the daylight saving time change
+	now := time.Date(2026, 10, 25, 22, 0, 0, 0, paris)
+	server.SetTime(now)
+	start, end := q.bounds(now)
+	assert.Equal(t, 25*time.Hour, end.Sub(start))
+	limit := Limit{Rate: 3, Burst: 3, Period: end.Sub(start)}
+
+	for i := 0; i < 3; i++ {
+		res, err := limiter.AllowQuota("1.2.3.4", limit, 1, end)
+		require.NoError(t, err)
+		assert.Equal(t, 1, res.Allowed)
+		assert.Equal(t, 2-i, res.Remaining)
+		assert.Equal(t, 2*time.Hour, res.ResetAfter)
+		assert.True(t, end.Equal(res.ResetAt), res.ResetAt)
+	}
+	res, err := limiter.AllowQuota("1.2.3.4", limit, 1, end)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+	assert.Equal(t, 2*time.Hour, res.RetryAfter)
+
+	// the quota expires at the end of the day, in Paris
+	server.FastForward(2*time.Hour - time.Second)
+	assert.True(t, server.Exists("quota_test1.2.3.4"))
+	server.FastForward(time.Second)
+	assert.False(t, server.Exists("quota_test1.2.3.4"))
+
+	server.SetTime(end)
+	_, end = q.bounds(end)
+	res, err = limiter.AllowQuota("1.2.3.4", limit, 1, end)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Allowed)
+	assert.Equal(t, 2, res.Remaining)
+	assert.Equal(t, 24*time.Hour, res.ResetAfter)
+}
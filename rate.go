@@ -3,9 +3,12 @@ package traefik_cluster_ratelimit
 import (
 	"context"
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/nzin/traefik-cluster-ratelimit/internal/breaker"
 	"github.com/nzin/traefik-cluster-ratelimit/internal/redis"
 )
 
@@ -15,6 +18,17 @@ type Limit struct {
 	Rate   int64
 	Burst  int64
 	Period time.Duration
+	// Tier is the name of the plan the limit comes from, if any
+	Tier string
+	// Reserve is the number of tokens of the burst kept for the higher priority
+	// classes. It is only used by the redis Limiter, with the GCRA algorithm,
+	// and is still kept when the limit of the key is overridden
+	Reserve int64
+	// RateFactor and BurstFactor scale an override of the limit of the key
+	// (see SetOverride) like this limit was scaled, by the adaptive and
+	// fair-share modes. 0 means no scaling. Only used by the redis Limiter
+	RateFactor  float64
+	BurstFactor float64
 }
 
 func (l Limit) String() string {
@@ -63,22 +77,150 @@ func PerHour(rate int64) Limit {
 
 // ------------------------------------------------------------------------------
 
+// RateLimiter is implemented by every backend able to store the rate limit state
+type RateLimiter interface {
+	AllowN(key string, limit Limit, n int) (*Result, error)
+	Reset(ctx context.Context, key string) error
+}
+
+// the algorithms available to the (redis) Limiter
+const (
+	// AlgorithmGCRA is the generic cell rate algorithm, a token bucket
+	AlgorithmGCRA = "gcra"
+	// AlgorithmSlidingLog allows at most Rate requests in any rolling Period,
+	// keeping the timestamps of the requests of the last Period
+	AlgorithmSlidingLog = "sliding-log"
+	// AlgorithmSlidingWindow approximates AlgorithmSlidingLog with two fixed window
+	// counters, weighting the previous window by how much of it is still in
+	// the rolling Period
+	AlgorithmSlidingWindow = "sliding-window"
+	// AlgorithmFixedWindow allows at most Rate requests per window of Period,
+	// the windows being aligned on the wall clock
+	AlgorithmFixedWindow = "fixed-window"
+)
+
 // Limiter controls how frequently events are allowed to happen.
 type Limiter struct {
-	rdb         redis.Client
-	allowN      redis.Script
-	allowAtMost redis.Script
-	redisPrefix string
+	rdb           redis.Client
+	algorithm     string
+	allowN        redis.Script
+	allowAtMost   redis.Script
+	reserveN      redis.Script
+	allowNAll     redis.Script
+	check         redis.Script
+	quota         redis.Script
+	adaptive      redis.Script
+	penalty       redis.Script
+	refund        redis.Script
+	setOverride   redis.Script
+	listOverrides redis.Script
+	hashGet       redis.Script
+	activeSources redis.Script
+	distinct      redis.Script
+	slidingLog    redis.Script
+	slidingWindow redis.Script
+	fixedWindow   redis.Script
+	acquire       redis.Script
+	renew         redis.Script
+	release       redis.Script
+	// the leases of the bandwidth, without overrides
+	leaseBandwidth  redis.Script
+	refundBandwidth redis.Script
+	redisPrefix     string
+	// prefix of the concurrency slots keys
+	concurrencyPrefix string
+	// prefix of the calendar quotas keys
+	quotaPrefix string
+	// key of the health factor of the adaptive limits
+	adaptiveKey string
+	// prefix of the penalty box keys
+	penaltyPrefix string
+	// prefix of the per-key overrides of the limits
+	overridePrefix string
+	// key of the sources seen by the fair-share limits
+	activeKey string
+	// prefix of the HyperLogLogs of the distinct-value limits
+	distinctPrefix string
+	// prefix of the keys of the multiple limits, apart from the sources
+	limitsPrefix string
+	// prefix of the keys of the named policies
+	policyPrefix string
+	// prefix of the bandwidth buckets of the sources
+	bandwidthPrefix string
+	// key of the bucket shared by the priority classes, and of its override
+	priorityKey         string
+	priorityOverrideKey string
+	// location aligns the fixed windows on a timezone (UTC if nil)
+	location *time.Location
 }
 
-// NewLimiter returns a new Limiter.
-func NewLimiter(rdb redis.Client, prefix string, breakerThreshold, breakerReattempt int64) *Limiter {
-	return &Limiter{
-		rdb:         rdb,
-		allowN:      redis.NewScriptWithBreaker(rdb.NewScript(allowNLua), breakerThreshold, breakerReattempt),
-		allowAtMost: redis.NewScriptWithBreaker(rdb.NewScript(allowAtMostLua), breakerThreshold, breakerReattempt),
-		redisPrefix: "rate_" + prefix,
+// NewLimiter returns a new Limiter, using the given algorithm.
+func NewLimiter(rdb redis.Client, prefix string, algorithm string, breakerThreshold, breakerReattempt int64) (*Limiter, error) {
+	switch algorithm {
+	case AlgorithmGCRA, AlgorithmSlidingLog, AlgorithmSlidingWindow, AlgorithmFixedWindow:
+	default:
+		return nil, fmt.Errorf("unknown algorithm %q", algorithm)
 	}
+
+	// all the scripts share the same breaker: they talk to the same redis
+	b := breaker.NewBreaker(breakerThreshold, breakerReattempt)
+	return &Limiter{
+		rdb:           rdb,
+		algorithm:     algorithm,
+		allowN:        redis.NewScriptWithSharedBreaker(rdb.NewScript(withOverride(allowNLua, 1, 2, 3)), b),
+		allowAtMost:   redis.NewScriptWithSharedBreaker(rdb.NewScript(allowAtMostLua), b),
+		reserveN:      redis.NewScriptWithSharedBreaker(rdb.NewScript(withOverride(reserveNLua, 1, 2, 3)), b),
+		allowNAll:     redis.NewScriptWithSharedBreaker(rdb.NewScript(allowNAllLua), b),
+		check:         redis.NewScriptWithSharedBreaker(rdb.NewScript(withOverride(checkLua, 1, 2, 3)), b),
+		quota:         redis.NewScriptWithSharedBreaker(rdb.NewScript(quotaLua), b),
+		adaptive:      redis.NewScriptWithSharedBreaker(rdb.NewScript(adaptiveLua), b),
+		penalty:       redis.NewScriptWithSharedBreaker(rdb.NewScript(withOverride(penaltyLua, 1, 2, 3)), b),
+		refund:        redis.NewScriptWithSharedBreaker(rdb.NewScript(withOverride(refundLua, 1, 2, 3)), b),
+		setOverride:   redis.NewScriptWithSharedBreaker(rdb.NewScript(setOverrideLua), b),
+		listOverrides: redis.NewScriptWithSharedBreaker(rdb.NewScript(listOverridesLua), b),
+		hashGet:       redis.NewScriptWithSharedBreaker(rdb.NewScript(hashGetLua), b),
+		activeSources: redis.NewScriptWithSharedBreaker(rdb.NewScript(activeSourcesLua), b),
+		distinct:      redis.NewScriptWithSharedBreaker(rdb.NewScript(distinctLua), b),
+		slidingLog:    redis.NewScriptWithSharedBreaker(rdb.NewScript(withOverride(slidingLogLua, 0, 1, 2)), b),
+		slidingWindow: redis.NewScriptWithSharedBreaker(rdb.NewScript(withOverride(slidingWindowLua, 0, 1, 2)), b),
+		fixedWindow:   redis.NewScriptWithSharedBreaker(rdb.NewScript(withOverride(fixedWindowLua, 0, 1, 2)), b),
+		acquire:       redis.NewScriptWithSharedBreaker(rdb.NewScript(acquireLua), b),
+		renew:         redis.NewScriptWithSharedBreaker(rdb.NewScript(renewLua), b),
+		release:       redis.NewScriptWithSharedBreaker(rdb.NewScript(releaseLua), b),
+		redisPrefix:   "rate_" + prefix,
+
+		leaseBandwidth:  redis.NewScriptWithSharedBreaker(rdb.NewScript(reserveNLua), b),
+		refundBandwidth: redis.NewScriptWithSharedBreaker(rdb.NewScript(refundLua), b),
+
+		concurrencyPrefix: "concurrency_" + prefix,
+		quotaPrefix:       "quota_" + prefix,
+		adaptiveKey:       "adaptive_" + prefix,
+		penaltyPrefix:     "penalty_" + prefix,
+		overridePrefix:    "rate_override:" + prefix + ":",
+		activeKey:         "active_" + prefix,
+		distinctPrefix:    "distinct_" + prefix,
+		limitsPrefix:      "limits_" + prefix,
+		policyPrefix:      "policy_" + prefix,
+		bandwidthPrefix:   "bandwidth_" + prefix,
+
+		priorityKey:         "priority_" + prefix,
+		priorityOverrideKey: "priority_override:" + prefix,
+	}, nil
+}
+
+// SetLocation aligns the windows of the fixed-window algorithm on a timezone,
+// which matters for hour (with non-whole hour offsets) and day windows
+func (l *Limiter) SetLocation(location *time.Location) {
+	l.location = location
+}
+
+// Priority returns a copy of the Limiter keeping the bucket shared by the
+// priority classes, and its override, apart from the buckets of the sources.
+// The bucket is the empty key of the copy.
+func (l Limiter) Priority() *Limiter {
+	l.redisPrefix = l.priorityKey
+	l.overridePrefix = l.priorityOverrideKey
+	return &l
 }
 
 // Allow is a shortcut for AllowN(ctx, key, limit, 1).
@@ -92,34 +234,208 @@ func (l Limiter) AllowN(
 	limit Limit,
 	n int,
 ) (*Result, error) {
+	switch l.algorithm {
+	case AlgorithmSlidingLog:
+		return l.allowNSliding(l.slidingLog, key, limit, n)
+	case AlgorithmSlidingWindow:
+		return l.allowNSliding(l.slidingWindow, key, limit, n)
+	case AlgorithmFixedWindow:
+		return l.allowNFixedWindow(key, limit, n)
+	}
+
 	values := []interface{}{limit.Burst, limit.Rate, limit.Period.Seconds(), n}
-	v, err := l.allowN.Run([]string{l.redisPrefix + key}, values...)
+	v, err := l.allowN.Run(l.withOverrideKey(key, l.redisPrefix+key), l.withOverrideArgs(limit, values...)...)
 	if err != nil {
 		return nil, err
 	}
 
-	values = v.([]interface{})
+	return newResult(v, limit)
+}
 
-	retryAfter, err := strconv.ParseFloat(values[2].(string), 64)
+// allowNSliding reports whether n events may happen at time now, without
+// going over limit.Rate events in the last limit.Period (limit.Burst is not used).
+func (l Limiter) allowNSliding(
+	script redis.Script,
+	key string,
+	limit Limit,
+	n int,
+) (*Result, error) {
+	values := []interface{}{limit.Rate, limit.Period.Seconds(), n}
+	v, err := script.Run(l.withOverrideKey(key, l.redisPrefix+key), l.withOverrideArgs(limit, values...)...)
 	if err != nil {
 		return nil, err
 	}
 
-	resetAfter, err := strconv.ParseFloat(values[3].(string), 64)
+	return newResult(v, limit)
+}
+
+// allowNFixedWindow reports whether n events may happen at time now, without
+// going over limit.Rate events in the current window (limit.Burst is not used).
+func (l Limiter) allowNFixedWindow(
+	key string,
+	limit Limit,
+	n int,
+) (*Result, error) {
+	offset := 0
+	if l.location != nil {
+		// the offset of now: windows around a daylight saving time change are
+		// shorter (or longer)
+		_, offset = time.Now().In(l.location).Zone()
+	}
+
+	values := []interface{}{limit.Rate, limit.Period.Seconds(), n, offset}
+	v, err := l.fixedWindow.Run(l.withOverrideKey(key, l.redisPrefix+key), l.withOverrideArgs(limit, values...)...)
 	if err != nil {
 		return nil, err
 	}
 
-	res := &Result{
-		Limit:      limit,
-		Allowed:    int(values[0].(int64)),
-		Remaining:  int(values[1].(int64)),
-		RetryAfter: dur(retryAfter),
-		ResetAfter: dur(resetAfter),
+	return newResult(v, limit)
+}
+
+// ReserveN reports whether n events may happen at time now, or within
+// maxDelay. In the latter case, the events are reserved, and Result.Delay
+// is how long they have to wait before happening. Only the GCRA algorithm
+// supports reservations.
+func (l Limiter) ReserveN(
+	key string,
+	limit Limit,
+	n int,
+	maxDelay time.Duration,
+) (*Result, error) {
+	values := []interface{}{limit.Burst, limit.Rate, limit.Period.Seconds(), n, maxDelay.Seconds()}
+	v, err := l.reserveN.Run(l.withOverrideKey(key, l.redisPrefix+key), l.withOverrideArgs(limit, values...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := newResult(v, limit)
+	if err != nil {
+		return nil, err
+	}
+	if res.Allowed > 0 {
+		// the script returns the delay in place of the retry after
+		res.Delay = res.RetryAfter
+		res.RetryAfter = -1
 	}
 	return res, nil
 }
 
+// Check reports whether an event may happen at time now, without consuming
+// anything. Only the GCRA algorithm is supported.
+func (l Limiter) Check(key string, limit Limit) (*Result, error) {
+	values := []interface{}{limit.Burst, limit.Rate, limit.Period.Seconds()}
+	v, err := l.check.Run(l.withOverrideKey(key, l.redisPrefix+key), l.withOverrideArgs(limit, values...)...)
+	if err != nil {
+		return nil, err
+	}
+	return newResult(v, limit)
+}
+
+// ChargeN consumes n events unconditionally: if they were not available, the
+// key goes into debt, and the next events are denied until it is repaid.
+// Result.Delay is how long it takes to repay the debt. Only the GCRA algorithm
+// is supported.
+func (l Limiter) ChargeN(key string, limit Limit, n int) (*Result, error) {
+	return l.ReserveN(key, limit, n, time.Duration(math.MaxInt64))
+}
+
+// LeaseBandwidth charges n bytes to the bandwidth of key, going into debt like
+// ChargeN. The bandwidth keys live apart from the ones of AllowN, and have no
+// override. Only the GCRA algorithm is supported.
+func (l Limiter) LeaseBandwidth(key string, limit Limit, n int) (*Result, error) {
+	values := []interface{}{limit.Burst, limit.Rate, limit.Period.Seconds(), n, time.Duration(math.MaxInt64).Seconds()}
+	v, err := l.leaseBandwidth.Run([]string{l.bandwidthPrefix + key}, values...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := newResult(v, limit)
+	if err != nil {
+		return nil, err
+	}
+	// the script returns the delay in place of the retry after
+	res.Delay = res.RetryAfter
+	res.RetryAfter = -1
+	return res, nil
+}
+
+// RefundBandwidth gives n bytes leased by LeaseBandwidth back to the bandwidth
+// of key
+func (l Limiter) RefundBandwidth(key string, limit Limit, n int) error {
+	values := []interface{}{limit.Burst, limit.Rate, limit.Period.Seconds(), n}
+	_, err := l.refundBandwidth.Run([]string{l.bandwidthPrefix + key}, values...)
+	return err
+}
+
+// AllowNAll reports whether n events may happen at time now, for each of the
+// keys with its own limit (keys and limits having the same length). The events
+// are only consumed if all the limits allow them, in a single atomic step.
+// It returns the Result of the most restrictive limit, and its index.
+// The keys live apart from the ones of AllowN, and their overrides are not
+// looked up (see SetOverride). Only the GCRA algorithm is supported.
+func (l Limiter) AllowNAll(
+	keys []string,
+	limits []Limit,
+	n int,
+) (*Result, int, error) {
+	redisKeys := make([]string, len(keys))
+	for i, key := range keys {
+		redisKeys[i] = l.limitsPrefix + key
+	}
+	return l.allowNAllKeys(redisKeys, limits, n)
+}
+
+// AllowNPolicies is AllowNAll for named policies: each key is scoped by the
+// name of its policy (names and keys having the same length), and lives apart
+// from the keys of AllowNAll. The names cannot contain a colon.
+func (l Limiter) AllowNPolicies(
+	names []string,
+	keys []string,
+	limits []Limit,
+	n int,
+) (*Result, int, error) {
+	if len(names) != len(keys) {
+		return nil, 0, fmt.Errorf("expected one policy name per key")
+	}
+
+	redisKeys := make([]string, len(keys))
+	for i, key := range keys {
+		redisKeys[i] = l.policyPrefix + names[i] + ":" + key
+	}
+	return l.allowNAllKeys(redisKeys, limits, n)
+}
+
+// allowNAllKeys runs the script of AllowNAll on the given redis keys
+func (l Limiter) allowNAllKeys(redisKeys []string, limits []Limit, n int) (*Result, int, error) {
+	if len(redisKeys) != len(limits) || len(redisKeys) == 0 {
+		return nil, 0, fmt.Errorf("expected one limit per key")
+	}
+
+	values := []interface{}{n}
+	for _, limit := range limits {
+		values = append(values, limit.Burst, limit.Rate, limit.Period.Seconds())
+	}
+	v, err := l.allowNAll.Run(redisKeys, values...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	values, ok := v.([]interface{})
+	if !ok || len(values) != 5 {
+		return nil, 0, fmt.Errorf("unexpected script result: %v", v)
+	}
+	index := int(values[4].(int64))
+	if index < 0 || index >= len(limits) {
+		return nil, 0, fmt.Errorf("unexpected limit index: %d", index)
+	}
+
+	res, err := newResult(values[:4], limits[index])
+	if err != nil {
+		return nil, 0, err
+	}
+	return res, index, nil
+}
+
 // AllowAtMost reports whether at most n events may happen at time now.
 // It returns number of allowed events that is less than or equal to n.
 func (l Limiter) AllowAtMost(
@@ -134,7 +450,312 @@ func (l Limiter) AllowAtMost(
 		return nil, err
 	}
 
-	values = v.([]interface{})
+	return newResult(v, limit)
+}
+
+// Acquire tries to take one of the max concurrency slots of key, identified
+// by id, for lease. It returns whether the slot was taken, and the number of
+// slots still available.
+func (l Limiter) Acquire(key string, max int64, lease time.Duration, id string) (bool, int, error) {
+	v, err := l.acquire.Run([]string{l.concurrencyPrefix + key}, max, lease.Seconds(), id)
+	if err != nil {
+		return false, 0, err
+	}
+
+	values, ok := v.([]interface{})
+	if !ok || len(values) < 2 {
+		return false, 0, fmt.Errorf("unexpected script result: %v", v)
+	}
+	return values[0].(int64) == 1, int(values[1].(int64)), nil
+}
+
+// Renew extends the lease of a slot taken with Acquire
+func (l Limiter) Renew(key string, lease time.Duration, id string) error {
+	_, err := l.renew.Run([]string{l.concurrencyPrefix + key}, lease.Seconds(), id)
+	return err
+}
+
+// Release gives back a slot taken with Acquire
+func (l Limiter) Release(key string, id string) error {
+	_, err := l.release.Run([]string{l.concurrencyPrefix + key}, id)
+	return err
+}
+
+// AllowQuota reports whether n events of the quota of key may happen, until
+// the end of the current period. key must identify the period: the counter
+// expires at its end. The overrides are not looked up (see SetOverride).
+func (l Limiter) AllowQuota(key string, limit Limit, n int, end time.Time) (*Result, error) {
+	values := []interface{}{limit.Rate, n, float64(end.UnixNano()) / float64(time.Second)}
+	v, err := l.quota.Run([]string{l.quotaPrefix + key}, values...)
+	if err != nil {
+		return nil, err
+	}
+
+	return newResult(v, limit)
+}
+
+// AllowDistinct counts the distinct values seen for a key (approximately,
+// with a HyperLogLog) until end, and reports whether value may be used: the
+// values already seen are always allowed, and a new one only while the count
+// stays within limit.Rate
+func (l Limiter) AllowDistinct(key string, value string, limit Limit, end time.Time) (*Result, error) {
+	values := []interface{}{value, limit.Rate, float64(end.UnixNano()) / float64(time.Second)}
+	// the scratch copy is specific to the key, like the HyperLogLog
+	v, err := l.distinct.Run([]string{l.distinctPrefix + key, l.distinctPrefix + key + ":scratch"}, values...)
+	if err != nil {
+		return nil, err
+	}
+
+	return newResult(v, limit)
+}
+
+// Adapt updates the health factor shared by all the instances, from the
+// health of the upstream seen by this instance: it is decreased (multiplied
+// by decrease) if unhealthy, and increased (by increase) otherwise, staying
+// between floor and ceiling. It returns the new factor.
+func (l Limiter) Adapt(healthy bool, increase, decrease, floor, ceiling float64, interval time.Duration) (float64, error) {
+	h := 0
+	if healthy {
+		h = 1
+	}
+	v, err := l.adaptive.Run([]string{l.adaptiveKey}, h, increase, decrease, floor, ceiling, interval.Seconds())
+	if err != nil {
+		return 0, err
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("unexpected script result: %v", v)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// ActiveSources marks the sources as seen now, and returns the number of
+// sources seen during the last window, by all the instances
+func (l Limiter) ActiveSources(sources []string, window time.Duration) (int64, error) {
+	args := make([]interface{}, 0, len(sources)+1)
+	args = append(args, window.Seconds())
+	for _, source := range sources {
+		args = append(args, source)
+	}
+	v, err := l.activeSources.Run([]string{l.activeKey}, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	count, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected script result: %v", v)
+	}
+	return count, nil
+}
+
+// RefundN gives back n events consumed by AllowN (or ReserveN), as long as
+// the key doesn't get more than its burst. Only the GCRA algorithm is supported.
+func (l Limiter) RefundN(key string, limit Limit, n int) error {
+	values := []interface{}{limit.Burst, limit.Rate, limit.Period.Seconds(), n}
+	_, err := l.refund.Run(l.withOverrideKey(key, l.redisPrefix+key), l.withOverrideArgs(limit, values...)...)
+	return err
+}
+
+// Penalty bans the keys rejected more than Threshold times within Window,
+// for Ban, doubling at each recurrence up to MaxBan
+type Penalty struct {
+	Threshold int64
+	Window    time.Duration
+	Ban       time.Duration
+	MaxBan    time.Duration
+}
+
+// AllowNWithPenalty is AllowN, with a penalty box checked in the same atomic
+// step. A banned key is denied until the end of its ban, which is its
+// RetryAfter. It also returns whether the key was just banned. Only the GCRA
+// algorithm is supported.
+func (l Limiter) AllowNWithPenalty(key string, limit Limit, n int, penalty Penalty) (*Result, bool, error) {
+	keys := l.withOverrideKey(
+		key,
+		l.redisPrefix+key,
+		l.penaltyPrefix+key+":ban",
+		l.penaltyPrefix+key+":rejections",
+		l.penaltyPrefix+key+":level",
+	)
+	values := []interface{}{
+		limit.Burst, limit.Rate, limit.Period.Seconds(), n,
+		penalty.Threshold, int64(penalty.Window.Seconds()), penalty.Ban.Seconds(), penalty.MaxBan.Seconds(),
+	}
+	v, err := l.penalty.Run(keys, l.withOverrideArgs(limit, values...)...)
+	if err != nil {
+		return nil, false, err
+	}
+
+	values, ok := v.([]interface{})
+	if !ok || len(values) < 5 {
+		return nil, false, fmt.Errorf("unexpected script result: %v", v)
+	}
+	// the fifth element is the ban flag, in place of the reset time
+	banned := values[4].(int64) == 1
+	values[4] = ""
+	res, err := newResult(values, limit)
+	if err != nil {
+		return nil, false, err
+	}
+	return res, banned, nil
+}
+
+// ResetPenalty lifts the ban of a key, and forgets its rejections
+func (l Limiter) ResetPenalty(key string) error {
+	for _, suffix := range []string{":ban", ":rejections", ":level"} {
+		if err := l.rdb.Del(l.penaltyPrefix + key + suffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withOverrideKey returns the keys of a script, followed by the key of the
+// override of the limit of key
+func (l Limiter) withOverrideKey(key string, keys ...string) []string {
+	return append(keys, l.overridePrefix+key)
+}
+
+// withOverrideArgs returns the arguments of a script, followed by the
+// adjustments of the limit that the script applies after the override lookup
+func (l Limiter) withOverrideArgs(limit Limit, values ...interface{}) []interface{} {
+	rateFactor, burstFactor := limit.RateFactor, limit.BurstFactor
+	if rateFactor == 0 {
+		rateFactor = 1
+	}
+	if burstFactor == 0 {
+		burstFactor = 1
+	}
+	return append(values, rateFactor, burstFactor, limit.Reserve)
+}
+
+// SetOverride replaces the limit of key, for all the Traefik instances, until
+// the override expires (0 means never) or is deleted. Only the single limit
+// algorithms look it up: AllowNAll, AllowNPolicies and AllowQuota ignore it,
+// an override of a source holding a single limit, not one per limit.
+func (l Limiter) SetOverride(key string, limit Limit, expiry time.Duration) error {
+	values := []interface{}{limit.Rate, limit.Burst, limit.Period.Seconds(), expiry.Milliseconds()}
+	_, err := l.setOverride.Run([]string{l.overridePrefix + key}, values...)
+	return err
+}
+
+// Override is a per-key override of the limit, as listed by ListOverrides
+type Override struct {
+	Key   string
+	Limit Limit
+	// ExpiresIn is -1 if the override never expires
+	ExpiresIn time.Duration
+}
+
+// ListOverrides returns the overrides of the limits of this middleware. The
+// keyspace is scanned one page per call, to not block redis
+func (l Limiter) ListOverrides() ([]Override, error) {
+	overrides := []Override{}
+	cursor := "0"
+	for {
+		v, err := l.listOverrides.Run([]string{}, l.overridePrefix, cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		values, ok := v.([]interface{})
+		if !ok || len(values)%5 != 1 {
+			return nil, fmt.Errorf("unexpected script result: %v", v)
+		}
+		cursor, ok = values[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected script cursor: %v", values[0])
+		}
+		overrides, err = l.appendOverrides(overrides, values[1:])
+		if err != nil {
+			return nil, err
+		}
+		if cursor == "0" {
+			return overrides, nil
+		}
+	}
+}
+
+// appendOverrides appends the overrides of a page of ListOverrides, as key,
+// rate, burst, period and time to live elements
+func (l Limiter) appendOverrides(overrides []Override, values []interface{}) ([]Override, error) {
+	for i := 0; i < len(values); i += 5 {
+		limit, err := parseOverride(values[i+1 : i+4])
+		if err != nil {
+			return nil, err
+		}
+		expiresIn := time.Duration(-1)
+		if ttl := values[i+4].(int64); ttl >= 0 {
+			expiresIn = time.Duration(ttl) * time.Millisecond
+		}
+		overrides = append(overrides, Override{
+			Key:       strings.TrimPrefix(values[i].(string), l.overridePrefix),
+			Limit:     limit,
+			ExpiresIn: expiresIn,
+		})
+	}
+	return overrides, nil
+}
+
+// DeleteOverride gives key its configured limit back
+func (l Limiter) DeleteOverride(key string) error {
+	return l.rdb.Del(l.overridePrefix + key)
+}
+
+// parseOverride converts the rate, burst and period (in seconds) of an
+// override into a Limit
+func parseOverride(values []interface{}) (Limit, error) {
+	var fields [3]float64
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			return Limit{}, fmt.Errorf("unexpected override: %v", values)
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return Limit{}, fmt.Errorf("invalid override: %v", err)
+		}
+		fields[i] = f
+	}
+	return Limit{
+		Rate:   int64(fields[0]),
+		Burst:  int64(fields[1]),
+		Period: dur(fields[2]),
+	}, nil
+}
+
+// HashGet returns a field of a Redis hash, or "" if it is missing
+func (l Limiter) HashGet(hash string, field string) (string, error) {
+	v, err := l.hashGet.Run([]string{hash}, field)
+	if err != nil {
+		return "", err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected script result: %v", v)
+	}
+	return s, nil
+}
+
+// Reset gets a key and reset all limitations and previous usages
+func (l *Limiter) Reset(ctx context.Context, key string) error {
+	if err := l.rdb.Del(l.bandwidthPrefix + key); err != nil {
+		return err
+	}
+	return l.rdb.Del(l.redisPrefix + key)
+}
+
+// newResult converts the {allowed, remaining, retry_after, reset_after}
+// array returned by the scripts into a Result. An optional fifth element
+// is the exact reset time, as an unix timestamp (or ""), and the optional
+// sixth to eighth ones the rate, burst and period of an override
+func newResult(v interface{}, limit Limit) (*Result, error) {
+	values, ok := v.([]interface{})
+	if !ok || len(values) < 4 {
+		return nil, fmt.Errorf("unexpected script result: %v", v)
+	}
 
 	retryAfter, err := strconv.ParseFloat(values[2].(string), 64)
 	if err != nil {
@@ -153,12 +774,24 @@ func (l Limiter) AllowAtMost(
 		RetryAfter: dur(retryAfter),
 		ResetAfter: dur(resetAfter),
 	}
-	return res, nil
-}
 
-// Reset gets a key and reset all limitations and previous usages
-func (l *Limiter) Reset(ctx context.Context, key string) error {
-	return l.rdb.Del(l.redisPrefix + key)
+	if len(values) > 4 && values[4].(string) != "" {
+		resetAt, err := strconv.ParseFloat(values[4].(string), 64)
+		if err != nil {
+			return nil, err
+		}
+		res.ResetAt = time.Unix(0, int64(resetAt*float64(time.Second)))
+	}
+
+	if len(values) > 7 {
+		override, err := parseOverride(values[5:8])
+		if err != nil {
+			return nil, err
+		}
+		res.Limit = override
+		res.Overridden = true
+	}
+	return res, nil
 }
 
 func dur(f float64) time.Duration {
@@ -192,4 +825,16 @@ type Result struct {
 	// Reset would return 800ms. You can also think of this as the time
 	// until Limit and Remaining will be equal.
 	ResetAfter time.Duration
+
+	// Delay is how long reserved events have to wait before happening
+	// (see ReserveN). It is 0 otherwise.
+	Delay time.Duration
+
+	// ResetAt is the exact time at which the current window ends, for
+	// the algorithms using fixed windows. It is zero otherwise.
+	ResetAt time.Time
+
+	// Overridden is true when Limit is a per-key override (see SetOverride),
+	// in place of the limit that was asked for.
+	Overridden bool
 }
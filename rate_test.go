@@ -0,0 +1,251 @@
+package traefik_cluster_ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/nzin/traefik-cluster-ratelimit/internal/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestLimiter returns a Limiter using a miniredis server. The time of the
+// server is frozen at the current time: the tests move it with SetTime
+func newTestLimiter(t *testing.T, algorithm string) (*Limiter, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	server.SetTime(time.Now())
+
+	client, err := redis.NewClient(server.Addr(), 0, "", time.Second)
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+
+	limiter, err := NewLimiter(client, "test", algorithm, 3, 15)
+	require.NoError(t, err)
+	return limiter, server
+}
+
+func TestNewLimiter(t *testing.T) {
+	_, err := NewLimiter(nil, "test", "leaky-bucket", 3, 15)
+	assert.Error(t, err)
+}
+
+func TestLimiterSlidingLog(t *testing.T) {
+	limiter, server := newTestLimiter(t, AlgorithmSlidingLog)
+	// the burst is not used by the sliding log
+	limit := Limit{Rate: 3, Burst: 1, Period: time.Minute}
+
+	for i := 0; i < 3; i++ {
+		res, err := limiter.AllowN("1.2.3.4", limit, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 1, res.Allowed)
+		assert.Equal(t, 2-i, res.Remaining)
+	}
+	res, err := limiter.AllowN("1.2.3.4", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Allowed)
+	assert.InDelta(t, time.Minute, res.RetryAfter, float64(time.Second))
+	assert.Equal(t, "zset", server.Type("rate_test1.2.3.4"))
+
+	// the requests leave the log one period later
+	server.SetTime(time.Now().Add(61 * time.Second))
+	res, err = limiter.AllowN("1.2.3.4", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Allowed)
+}
+
+func TestLimiterSlidingWindow(t *testing.T) {
+	limiter, server := newTestLimiter(t, AlgorithmSlidingWindow)
+	limit := Limit{Rate: 4, Burst: 1, Period: time.Minute}
+	// at the start of a window
+	start := time.Unix(jan1st2024+(time.Now().Unix()-jan1st2024)/60*60, 0)
+	server.SetTime(start)
+
+	res, err := limiter.AllowN("1.2.3.4", limit, 4)
+	require.NoError(t, err)
+	assert.Equal(t, 4, res.Allowed)
+	res, err = limiter.AllowN("1.2.3.4", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Allowed)
+	assert.Equal(t, "hash", server.Type("rate_test1.2.3.4"))
+
+	// half way in the next window, half of the previous one still counts
+	server.SetTime(start.Add(90 * time.Second))
+	res, err = limiter.AllowN("1.2.3.4", limit, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.Allowed)
+	res, err = limiter.AllowN("1.2.3.4", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Allowed)
+
+	// only the current and previous windows are kept
+	server.SetTime(start.Add(150 * time.Second))
+	_, err = limiter.AllowN("1.2.3.4", limit, 1)
+	require.NoError(t, err)
+	fields, err := server.HKeys("rate_test1.2.3.4")
+	require.NoError(t, err)
+	assert.Len(t, fields, 2)
+}
+
+func TestLimiterFixedWindow(t *testing.T) {
+	limiter, server := newTestLimiter(t, AlgorithmFixedWindow)
+	limit := Limit{Rate: 3, Burst: 1, Period: time.Minute}
+	start := time.Now().Truncate(time.Minute)
+	server.SetTime(start.Add(50 * time.Second))
+
+	res, err := limiter.AllowN("1.2.3.4", limit, 3)
+	require.NoError(t, err)
+	assert.Equal(t, 3, res.Allowed)
+	res, err = limiter.AllowN("1.2.3.4", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Allowed)
+	assert.Equal(t, start.Add(time.Minute), res.ResetAt)
+	assert.Equal(t, 10*time.Second, res.RetryAfter)
+
+	// the counter starts again at the window boundary
+	server.SetTime(start.Add(time.Minute))
+	res, err = limiter.AllowN("1.2.3.4", limit, 3)
+	require.NoError(t, err)
+	assert.Equal(t, 3, res.Allowed)
+	fields, err := server.HKeys("rate_test1.2.3.4")
+	require.NoError(t, err)
+	assert.Len(t, fields, 1)
+}
+
+func TestLimiterReset(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmGCRA, AlgorithmSlidingLog, AlgorithmSlidingWindow, AlgorithmFixedWindow} {
+		t.Run(algorithm, func(t *testing.T) {
+			limiter, _ := newTestLimiter(t, algorithm)
+			limit := Limit{Rate: 2, Burst: 2, Period: time.Hour}
+
+			res, err := limiter.AllowN("1.2.3.4", limit, 2)
+			require.NoError(t, err)
+			assert.Equal(t, 2, res.Allowed)
+			res, err = limiter.AllowN("1.2.3.4", limit, 1)
+			require.NoError(t, err)
+			assert.Equal(t, 0, res.Allowed)
+
+			require.NoError(t, limiter.Reset(context.Background(), "1.2.3.4"))
+			res, err = limiter.AllowN("1.2.3.4", limit, 2)
+			require.NoError(t, err)
+			assert.Equal(t, 2, res.Allowed)
+		})
+	}
+}
+
+func TestLimiterAllowNAll(t *testing.T) {
+	limiter, server := newTestLimiter(t, AlgorithmGCRA)
+	keys := []string{"second", "minute"}
+	limits := []Limit{
+		{Rate: 10, Burst: 10, Period: time.Second},
+		{Rate: 3, Burst: 3, Period: time.Minute},
+	}
+
+	_, _, err := limiter.AllowNAll(keys, limits[:1], 1)
+	assert.Error(t, err)
+	_, _, err = limiter.AllowNPolicies([]string{"policy"}, keys, limits, 1)
+	assert.Error(t, err)
+
+	for i := 0; i < 3; i++ {
+		res, index, err := limiter.AllowNAll(keys, limits, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 1, res.Allowed)
+		// the per minute limit is the most restrictive
+		assert.Equal(t, 1, index)
+		assert.Equal(t, 2-i, res.Remaining)
+	}
+	res, index, err := limiter.AllowNAll(keys, limits, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Allowed)
+	assert.Equal(t, 1, index)
+	assert.Equal(t, limits[1], res.Limit)
+
+	// the keys are apart from the ones of AllowN
+	assert.True(t, server.Exists("limits_testminute"))
+	res, err = limiter.AllowN("minute", limits[1], 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Allowed)
+
+	// the rejected request did not use the per second budget
+	server.SetTime(time.Now().Add(20 * time.Second))
+	res, index, err = limiter.AllowNAll(keys, limits, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Allowed)
+	assert.Equal(t, 1, index)
+}
+
+func TestLimiterAllowNAllIgnoresOverrides(t *testing.T) {
+	limiter, _ := newTestLimiter(t, AlgorithmGCRA)
+	limits := []Limit{{Rate: 1, Burst: 1, Period: time.Minute}}
+	require.NoError(t, limiter.SetOverride("1.2.3.4", Limit{Rate: 10, Burst: 10, Period: time.Minute}, 0))
+
+	res, _, err := limiter.AllowNAll([]string{"1.2.3.4"}, limits, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Allowed)
+	res, _, err = limiter.AllowNAll([]string{"1.2.3.4"}, limits, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Allowed)
+	assert.False(t, res.Overridden)
+}
+
+func TestLimiterOverride(t *testing.T) {
+	limiter, server := newTestLimiter(t, AlgorithmGCRA)
+	limit := Limit{Rate: 1, Burst: 1, Period: time.Minute}
+	override := Limit{Rate: 10, Burst: 4, Period: time.Minute}
+
+	// applied
+	require.NoError(t, limiter.SetOverride("1.2.3.4", override, time.Hour))
+	for i := 0; i < 4; i++ {
+		res, err := limiter.AllowN("1.2.3.4", limit, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 1, res.Allowed, i)
+		assert.True(t, res.Overridden)
+		assert.Equal(t, override, res.Limit)
+	}
+	res, err := limiter.AllowN("1.2.3.4", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Allowed)
+
+	// the other keys keep their limit
+	res, err = limiter.AllowN("5.6.7.8", limit, 1)
+	require.NoError(t, err)
+	assert.False(t, res.Overridden)
+	assert.Equal(t, limit, res.Limit)
+
+	overrides, err := limiter.ListOverrides()
+	require.NoError(t, err)
+	require.Len(t, overrides, 1)
+	assert.Equal(t, "1.2.3.4", overrides[0].Key)
+	assert.Equal(t, override, overrides[0].Limit)
+	assert.Equal(t, time.Hour, overrides[0].ExpiresIn)
+
+	// scaled like the configured limit
+	require.NoError(t, limiter.Reset(context.Background(), "1.2.3.4"))
+	scaled := limit
+	scaled.RateFactor = 0.5
+	scaled.BurstFactor = 0.5
+	res, err = limiter.AllowN("1.2.3.4", scaled, 1)
+	require.NoError(t, err)
+	assert.Equal(t, Limit{Rate: 5, Burst: 2, Period: time.Minute}, res.Limit)
+	assert.Equal(t, 1, res.Remaining)
+
+	// expired
+	server.FastForward(time.Hour)
+	res, err = limiter.AllowN("1.2.3.4", limit, 1)
+	require.NoError(t, err)
+	assert.False(t, res.Overridden)
+	overrides, err = limiter.ListOverrides()
+	require.NoError(t, err)
+	assert.Empty(t, overrides)
+
+	// deleted
+	require.NoError(t, limiter.SetOverride("1.2.3.4", override, 0))
+	res, err = limiter.Check("1.2.3.4", limit)
+	require.NoError(t, err)
+	assert.True(t, res.Overridden)
+	require.NoError(t, limiter.DeleteOverride("1.2.3.4"))
+	res, err = limiter.Check("1.2.3.4", limit)
+	require.NoError(t, err)
+	assert.False(t, res.Overridden)
+}
@@ -2,17 +2,25 @@ package traefik_cluster_ratelimit
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/nzin/traefik-cluster-ratelimit/internal/memcached"
+	"github.com/nzin/traefik-cluster-ratelimit/internal/peers"
 	"github.com/nzin/traefik-cluster-ratelimit/internal/redis"
 	"github.com/nzin/traefik-cluster-ratelimit/internal/utils"
 )
 
 // Config the plugin configuration.
 type Config struct {
+	// Backend is where the rate limit state is stored: "redis" (the default),
+	// "memcached", "peers" (shared between the Traefik instances themselves)
+	// or "rls" (decisions delegated to an Envoy-style rate limit service)
+	Backend string `json:"backend,omitempty" yaml:"backend,omitempty"`
 	// RedisAddress is the address of the redis server, as "host:port"
 	// the default is "redis:6379"
 	RedisAddress string `json:"redisAddress,omitempty" yaml:"redisAddress,omitempty"`
@@ -24,6 +32,37 @@ type Config struct {
 	// you can use an environment variable, and put the name of the env variable here
 	// prefixed with '$'. For example '$REDIS_AUTH_PASSWORD'
 	RedisPassword string `json:"redisPassword,omitempty" yaml:"redisPassword,omitempty"`
+	// MemcachedAddress is the address of the memcached server, as "host:port",
+	// used with the "memcached" backend. The default is "memcached:11211"
+	MemcachedAddress string `json:"memcachedAddress,omitempty" yaml:"memcachedAddress,omitempty"`
+	// Peers is the static list of the Traefik instances ("host:port" of their
+	// PeerListenAddress), used with the "peers" backend. This instance must be part of it
+	Peers []string `json:"peers,omitempty" yaml:"peers,omitempty"`
+	// PeersDNS is a DNS name, as "name:port", resolving to the addresses of all the
+	// Traefik instances (like a kubernetes headless service). It replaces Peers
+	PeersDNS string `json:"peersDns,omitempty" yaml:"peersDns,omitempty"`
+	// PeerListenAddress is where this instance listens for the other peers.
+	// The default is ":7946"
+	PeerListenAddress string `json:"peerListenAddress,omitempty" yaml:"peerListenAddress,omitempty"`
+	// PeerSecret must be sent by the peers talking to this instance, and is mandatory
+	// with the "peers" backend. Like RedisPassword, it can be read from an environment variable: '$PEER_SECRET'
+	PeerSecret string `json:"peerSecret,omitempty" yaml:"peerSecret,omitempty"`
+	// PeerTimeout is the timeout, in milliseconds, of a call to another peer,
+	// after which the decision is taken locally. By default it is 100ms
+	PeerTimeout int64 `json:"peerTimeout,omitempty" yaml:"peerTimeout,omitempty"`
+	// PeerRefresh is the number of seconds between two refreshes of the list of
+	// alive peers. By default it is 5 seconds
+	PeerRefresh int64 `json:"peerRefresh,omitempty" yaml:"peerRefresh,omitempty"`
+	// RLSAddress is the base URL of the rate limit service HTTP/JSON API, used with
+	// the "rls" backend. The default is "http://ratelimit:8080"
+	RLSAddress string `json:"rlsAddress,omitempty" yaml:"rlsAddress,omitempty"`
+	// RLSDomain is the rate limit service domain of the descriptors
+	RLSDomain string `json:"rlsDomain,omitempty" yaml:"rlsDomain,omitempty"`
+	// RLSSourceKey is the descriptor entry key holding the extracted source.
+	// The default is "remote_address"
+	RLSSourceKey string `json:"rlsSourceKey,omitempty" yaml:"rlsSourceKey,omitempty"`
+	// RLSDescriptorEntries are extra descriptor entries, sent before the source entry
+	RLSDescriptorEntries []RLSEntry `json:"rlsDescriptorEntries,omitempty" yaml:"rlsDescriptorEntries,omitempty"`
 	// Average is the maximum rate, by default in requests/s, allowed for the given source.
 	// It defaults to 0, which means no rate limiting.
 	// The rate is actually defined by dividing Average by Period. So for a rate below 1req/s,
@@ -35,6 +74,128 @@ type Config struct {
 	// Period, in combination with Average, defines the actual maximum rate, such as:
 	// r = Average / Period. It defaults to a second.
 	Period int64 `json:"period,omitempty" yaml:"period,omitempty"`
+	// Limits is a list of limits (like "10 per second AND 300 per minute") checked together,
+	// atomically: the request is allowed, and the tokens consumed, only if all of them allow
+	// it. Only with the redis backend and the gcra algorithm. When set, Average, Burst and
+	// Period must not be set. The per-key overrides do not apply to them
+	Limits []LimitConfig `json:"limits,omitempty" yaml:"limits,omitempty"`
+	// Policies is a list of named limits, each with its own SourceCriterion (like a per IP,
+	// a per API key and a global limit), checked together atomically like Limits. The
+	// X-RateLimit-Policy header of a rejection tells which policy rejected the request.
+	// Limits and Policies are mutually exclusive, and the per-key overrides do not apply to them
+	Policies []PolicyConfig `json:"policies,omitempty" yaml:"policies,omitempty"`
+	// CostRules give the cost of the requests (the number of requests they count for),
+	// by method, path or header, like 5 for "POST /search". The first matching rule
+	// wins, and the other requests cost 1
+	CostRules []CostRule `json:"costRules,omitempty" yaml:"costRules,omitempty"`
+	// CostHeader is a trusted request header holding the cost of the request (set by
+	// a previous middleware, for example). When present, it takes precedence over CostRules
+	CostHeader string `json:"costHeader,omitempty" yaml:"costHeader,omitempty"`
+	// ResponseCostHeader enables the post-response cost accounting: the request is let through
+	// if the source has some quota left, and the cost reported by the upstream in this response
+	// header (or trailer), like "X-RateLimit-Cost", is charged afterward. The source can go into
+	// debt, its next requests being rejected until the debt is repaid. The header is not sent to
+	// the client. Only with the redis backend and the gcra algorithm
+	ResponseCostHeader string `json:"responseCostHeader,omitempty" yaml:"responseCostHeader,omitempty"`
+	// Quota is the number of requests allowed per calendar QuotaPeriod, for the given source,
+	// alongside the rate limit. It defaults to 0, which means no quota. Only with the redis backend.
+	// The per-key overrides only apply to the rate limit, not to the quota
+	Quota int64 `json:"quota,omitempty" yaml:"quota,omitempty"`
+	// QuotaPeriod is "hour", "day", "week" or "month"
+	QuotaPeriod string `json:"quotaPeriod,omitempty" yaml:"quotaPeriod,omitempty"`
+	// QuotaTimezone is the timezone of the periods, like "Europe/Paris". By default it is UTC
+	QuotaTimezone string `json:"quotaTimezone,omitempty" yaml:"quotaTimezone,omitempty"`
+	// QuotaAnchor is the start of a period, as "2006-01-02T15:04:05" in QuotaTimezone: the
+	// periods start at its minute (hour), its time (day), its weekday and time (week), or its
+	// day of the month and time (month). By default "2024-01-01T00:00:00", a Monday at midnight
+	QuotaAnchor string `json:"quotaAnchor,omitempty" yaml:"quotaAnchor,omitempty"`
+	// Adaptive scales the rate limit (Average) with the health of the upstream: the rate is
+	// halved when the upstream is unhealthy (too many 5xx, or too slow), and grows back by 5%
+	// of Average per AdaptiveInterval otherwise. The factor is shared by all the Traefik
+	// instances through Redis. Only with the redis backend
+	Adaptive bool `json:"adaptive,omitempty" yaml:"adaptive,omitempty"`
+	// AdaptiveFloor is the minimum rate, in percent of Average. By default it is 10
+	AdaptiveFloor int64 `json:"adaptiveFloor,omitempty" yaml:"adaptiveFloor,omitempty"`
+	// AdaptiveCeiling is the maximum rate, in percent of Average. By default it is 100
+	AdaptiveCeiling int64 `json:"adaptiveCeiling,omitempty" yaml:"adaptiveCeiling,omitempty"`
+	// AdaptiveMaxErrorRate is the percentage of 5xx responses above which the upstream is
+	// unhealthy. By default it is 5
+	AdaptiveMaxErrorRate int64 `json:"adaptiveMaxErrorRate,omitempty" yaml:"adaptiveMaxErrorRate,omitempty"`
+	// AdaptiveMaxLatency, in milliseconds, is the latency percentile above which the upstream
+	// is unhealthy. By default it is 0 (the latency is not used)
+	AdaptiveMaxLatency int64 `json:"adaptiveMaxLatency,omitempty" yaml:"adaptiveMaxLatency,omitempty"`
+	// AdaptiveLatencyPercentile is the percentile compared to AdaptiveMaxLatency. By default it is 95
+	AdaptiveLatencyPercentile int64 `json:"adaptiveLatencyPercentile,omitempty" yaml:"adaptiveLatencyPercentile,omitempty"`
+	// AdaptiveInterval is the number of seconds between two updates of the factor. By default it is 10
+	AdaptiveInterval int64 `json:"adaptiveInterval,omitempty" yaml:"adaptiveInterval,omitempty"`
+	// PenaltyThreshold enables the penalty box: a source rejected more than PenaltyThreshold
+	// times within PenaltyWindow is banned for PenaltyDuration, the duration doubling each time
+	// the ban recurs, up to PenaltyMaxDuration. The bans are stored in Redis, and checked in
+	// the same call as the rate limit. Only with the redis backend and the gcra algorithm.
+	// By default it is 0 (disabled)
+	PenaltyThreshold int64 `json:"penaltyThreshold,omitempty" yaml:"penaltyThreshold,omitempty"`
+	// PenaltyWindow is the number of seconds the rejections are counted over. By default it is 60
+	PenaltyWindow int64 `json:"penaltyWindow,omitempty" yaml:"penaltyWindow,omitempty"`
+	// PenaltyDuration is the number of seconds of the first ban. By default it is 60
+	PenaltyDuration int64 `json:"penaltyDuration,omitempty" yaml:"penaltyDuration,omitempty"`
+	// PenaltyMaxDuration is the maximum number of seconds of a ban. By default it is 3600
+	PenaltyMaxDuration int64 `json:"penaltyMaxDuration,omitempty" yaml:"penaltyMaxDuration,omitempty"`
+	// RefundOnStatus gives the cost of a request back when the upstream answers with one of
+	// these status codes ("503") or ranges ("500-599"), so that the retries of the clients
+	// are not charged twice. Only with the redis backend and the gcra algorithm
+	RefundOnStatus []string `json:"refundOnStatus,omitempty" yaml:"refundOnStatus,omitempty"`
+	// RefundOnHeaders gives the cost of a request back when the upstream response has one
+	// of these headers
+	RefundOnHeaders []string `json:"refundOnHeaders,omitempty" yaml:"refundOnHeaders,omitempty"`
+	// PriorityClasses, from the highest priority to the lowest one, shed the low priority
+	// traffic first: all the requests share a single bucket, and a request of a class can only
+	// use it down to the reserve of its class, kept for the higher classes. The requests
+	// matching no class belong to the last one. Only with the redis backend and the gcra algorithm
+	PriorityClasses []PriorityClass `json:"priorityClasses,omitempty" yaml:"priorityClasses,omitempty"`
+	// Tiers replace Average, Burst and Period with the plan of the client, found from a
+	// header or a JWT claim
+	Tiers *TiersConfig `json:"tiers,omitempty" yaml:"tiers,omitempty"`
+	// FairShare splits Average (the capacity of the upstream) between the sources active
+	// during the last FairShareWindow seconds, across all the instances. Only with the redis backend
+	FairShare bool `json:"fairShare,omitempty" yaml:"fairShare,omitempty"`
+	// FairShareMin is the minimum average of a source. By default it is 1
+	FairShareMin int64 `json:"fairShareMin,omitempty" yaml:"fairShareMin,omitempty"`
+	// FairShareMax is the maximum average of a source. By default it is Average
+	FairShareMax int64 `json:"fairShareMax,omitempty" yaml:"fairShareMax,omitempty"`
+	// FairShareWindow is the number of seconds a source stays active after its last request.
+	// By default it is 10
+	FairShareWindow int64 `json:"fairShareWindow,omitempty" yaml:"fairShareWindow,omitempty"`
+	// DistinctLimits limit the number of distinct values (like IPs or usernames) used by a
+	// source (like an API key) per period. Only with the redis backend
+	DistinctLimits []DistinctLimitConfig `json:"distinctLimits,omitempty" yaml:"distinctLimits,omitempty"`
+	// FailureStatus only charges the requests the upstream answers with one of these status
+	// codes ("401") or ranges ("400-499"), like the failed logins. The requests are still
+	// rejected once the source has no quota left. Only with the redis backend and the gcra algorithm
+	FailureStatus []string `json:"failureStatus,omitempty" yaml:"failureStatus,omitempty"`
+	// FailureResetStatus clears the failures of the source when the upstream answers with
+	// one of these status codes or ranges, like a successful login
+	FailureResetStatus []string `json:"failureResetStatus,omitempty" yaml:"failureResetStatus,omitempty"`
+	// Bandwidth paces the responses to this number of bytes per second per source, across all
+	// the instances. 0 means unlimited. Only with the redis backend and the gcra algorithm
+	Bandwidth int64 `json:"bandwidth,omitempty" yaml:"bandwidth,omitempty"`
+	// BandwidthBurst is the number of bytes a source can get at once. By default it is Bandwidth
+	BandwidthBurst int64 `json:"bandwidthBurst,omitempty" yaml:"bandwidthBurst,omitempty"`
+	// BandwidthChunk is the number of bytes leased at once from Redis. By default it is 16384
+	// (or BandwidthBurst if lower)
+	BandwidthChunk int64 `json:"bandwidthChunk,omitempty" yaml:"bandwidthChunk,omitempty"`
+	// Algorithm is the rate limiting algorithm, when using the redis backend:
+	// - "gcra" (the default): a token bucket, allowing Burst requests at once
+	// - "sliding-log": at most Average requests in any rolling Period (Burst is not used)
+	// - "sliding-window": an approximation of "sliding-log", using less memory
+	// - "fixed-window": at most Average requests per window of Period, aligned on the wall clock
+	// The other backends only support "gcra"
+	Algorithm string `json:"algorithm,omitempty" yaml:"algorithm,omitempty"`
+	// WindowTimezone aligns the windows of the "fixed-window" algorithm on a timezone
+	// (like "Europe/Paris"), for hour and day windows. By default they are aligned on UTC
+	WindowTimezone string `json:"windowTimezone,omitempty" yaml:"windowTimezone,omitempty"`
+	// Headers adds the X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset
+	// (as an unix timestamp) headers to the responses
+	Headers bool `json:"headers,omitempty" yaml:"headers,omitempty"`
 	// SourceCriterion defines what criterion is used to group requests as originating from a common source.
 	// If several strategies are defined at the same time, an error will be raised.
 	// If none are set, the default is to use the request's remote address field (as an ipStrategy).
@@ -45,9 +206,35 @@ type Config struct {
 	// BreakerReattempt is the number of seconds to wait (after stopping to Redis) before
 	// trying to talk again to Redis (default is 15)
 	BreakerReattempt int64 `json:"breakerReattempt,omitempty" yaml:"breakerReattempt,omitempty"`
-	// ConnectionTimeout is the read and write connection timeout to redis.
-	// By default it is 2 seconds
+	// ConnectionTimeout is the read and write connection timeout to redis
+	// (or memcached). By default it is 2 seconds
 	RedisConnectionTimeout int64 `json:"redisConnectionTimeout,omitempty" yaml:"redisConnectionTimeout,omitempty"`
+	// OptimisticBudget, in milliseconds, enables the optimistic mode: if the decision
+	// is not taken within this latency budget, the request is let through, and the
+	// usage is still recorded in the background. By default it is 0 (disabled)
+	OptimisticBudget int64 `json:"optimisticBudget,omitempty" yaml:"optimisticBudget,omitempty"`
+	// DenyCacheSize is the maximum number of denied sources kept locally: until their
+	// retry-after expires, their requests are rejected without calling the backend.
+	// By default it is 0 (disabled)
+	DenyCacheSize int64 `json:"denyCacheSize,omitempty" yaml:"denyCacheSize,omitempty"`
+	// MaxConcurrent is the maximum number of in-flight requests allowed for the given
+	// source, across the cluster (only with the redis backend). It defaults to 0, which
+	// means no concurrency limiting. It can be used with, or without, the rate limit
+	MaxConcurrent int64 `json:"maxConcurrent,omitempty" yaml:"maxConcurrent,omitempty"`
+	// ConcurrencyLease is the number of seconds after which the concurrency slot of a
+	// request is freed if its Traefik instance stopped renewing it (crashed). It
+	// defaults to 30 seconds
+	ConcurrencyLease int64 `json:"concurrencyLease,omitempty" yaml:"concurrencyLease,omitempty"`
+	// MaxDelay, in milliseconds, enables traffic shaping: a request that would be allowed
+	// within MaxDelay is delayed (its tokens are reserved) instead of being rejected.
+	// Only with the redis backend and the gcra algorithm. By default it is 0 (disabled)
+	MaxDelay int64 `json:"maxDelay,omitempty" yaml:"maxDelay,omitempty"`
+	// MaxWaiting is the maximum number of requests waiting at once (per Traefik instance)
+	// because of MaxDelay. The next ones are rejected. By default it is 100
+	MaxWaiting int64 `json:"maxWaiting,omitempty" yaml:"maxWaiting,omitempty"`
+	// MetricsAddress, if set, is where the metrics of all the middlewares are exposed,
+	// in the prometheus format, under /metrics. For example ":9101"
+	MetricsAddress string `json:"metricsAddress,omitempty" yaml:"metricsAddress,omitempty"`
 }
 
 // CreateConfig creates the default plugin configuration.
@@ -56,24 +243,128 @@ func CreateConfig() *Config {
 }
 
 type ClusterRateLimit struct {
-	next          http.Handler
-	limiter       *Limiter
-	name          string
-	average       int64
-	burst         int64
-	period        int64
+	next    http.Handler
+	limiter RateLimiter
+	name    string
+	average int64
+	burst   int64
+	period  int64
+	// when there are several limits (or policies), in place of average/burst/period
+	policies      []policy
+	headers       bool
 	sourceMatcher utils.SourceExtractor
+	costs         *costResolver
+	// the redis limiter, before being wrapped. nil with the other backends
+	redis *Limiter
+
+	responseCostHeader string
+
+	// nil if there is no quota
+	quota *quota
+	// nil if the limit is not adaptive
+	adaptive *adaptiveLimit
+	// nil if nothing is refunded
+	refund *refund
+
+	priorityClasses []PriorityClass
+	// nil if there are no tiers
+	tiers *tiers
+	// nil if the limit is not shared
+	fairShare *fairShare
+
+	distinctLimits []distinctLimit
+
+	// nil if all the requests are charged
+	failures *failures
+	// nil if the bandwidth is unlimited
+	bandwidth *bandwidth
+
+	maxConcurrent    int64
+	concurrencyLease time.Duration
+
+	maxDelay time.Duration
+	// one element per waiting request
+	waiting chan struct{}
 }
 
 // New created a new ClusterRateLimit plugin.
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
+	if config.Backend == "" {
+		config.Backend = "redis"
+	}
+	if config.Algorithm == "" {
+		config.Algorithm = AlgorithmGCRA
+	}
+	if config.Backend != "redis" && config.Algorithm != AlgorithmGCRA {
+		return nil, fmt.Errorf("the %s backend only supports the %s algorithm", config.Backend, AlgorithmGCRA)
+	}
+	if config.WindowTimezone != "" && config.Algorithm != AlgorithmFixedWindow {
+		return nil, fmt.Errorf("windowTimezone is only supported by the %s algorithm", AlgorithmFixedWindow)
+	}
 	if config.RedisAddress == "" {
 		config.RedisAddress = "redis:6379"
 	}
+	if config.MemcachedAddress == "" {
+		config.MemcachedAddress = "memcached:11211"
+	}
+	if config.RLSAddress == "" {
+		config.RLSAddress = "http://ratelimit:8080"
+	}
+	if config.RLSSourceKey == "" {
+		config.RLSSourceKey = "remote_address"
+	}
+	if config.PeerListenAddress == "" {
+		config.PeerListenAddress = ":7946"
+	}
+	if config.PeerTimeout < 1 {
+		config.PeerTimeout = 100
+	}
+	if config.PeerRefresh < 1 {
+		config.PeerRefresh = 5
+	}
 	if config.Average < 0 {
 		return nil, fmt.Errorf("average must be >=0. 0 means unlimited")
 	}
-	if config.Burst < 1 {
+	if len(config.Limits) > 0 && len(config.Policies) > 0 {
+		return nil, fmt.Errorf("limits and policies are mutually exclusive")
+	}
+	policies, err := newLimits(config.Limits)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Policies) > 0 {
+		policies, err = newPolicies(config.Policies)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.Tiers != nil {
+		if config.Average != 0 || config.Burst != 0 || config.Period != 0 {
+			return nil, fmt.Errorf("tiers and average/burst/period are mutually exclusive")
+		}
+		if len(policies) > 0 || len(config.PriorityClasses) > 0 {
+			return nil, fmt.Errorf("tiers cannot be used with limits, policies or priorityClasses")
+		}
+		// the default plan is the limit of the middleware
+		plan, ok := config.Tiers.Plans[config.Tiers.Default]
+		if !ok {
+			return nil, fmt.Errorf("the default tier %q is not one of the plans", config.Tiers.Default)
+		}
+		config.Average = plan.Average
+		config.Burst = plan.Burst
+		config.Period = plan.Period
+	}
+	if len(policies) > 0 {
+		if config.Average != 0 || config.Burst != 0 || config.Period != 0 {
+			return nil, fmt.Errorf("limits/policies and average/burst/period are mutually exclusive")
+		}
+		if config.Backend != "redis" || config.Algorithm != AlgorithmGCRA {
+			return nil, fmt.Errorf("limits/policies are only supported by the redis backend, with the %s algorithm", AlgorithmGCRA)
+		}
+		if config.MaxDelay > 0 || config.OptimisticBudget > 0 || config.DenyCacheSize > 0 {
+			return nil, fmt.Errorf("limits/policies cannot be used with maxDelay, optimisticBudget or denyCacheSize")
+		}
+	} else if config.Average > 0 && config.Burst < 1 {
 		return nil, fmt.Errorf("burst must be >=1")
 	}
 	if config.Period < 1 {
@@ -88,75 +379,616 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 	if config.RedisConnectionTimeout < 1 {
 		config.RedisConnectionTimeout = 2
 	}
+	if config.OptimisticBudget < 0 {
+		return nil, fmt.Errorf("optimisticBudget must be >=0. 0 means disabled")
+	}
+	if config.MaxConcurrent < 0 {
+		return nil, fmt.Errorf("maxConcurrent must be >=0. 0 means unlimited")
+	}
+	if config.MaxConcurrent > 0 && config.Backend != "redis" {
+		return nil, fmt.Errorf("maxConcurrent is only supported by the redis backend")
+	}
+	if config.ConcurrencyLease < 1 {
+		config.ConcurrencyLease = 30
+	}
+	if config.MaxDelay < 0 {
+		return nil, fmt.Errorf("maxDelay must be >=0. 0 means disabled")
+	}
+	if config.MaxDelay > 0 && (config.Backend != "redis" || config.Algorithm != AlgorithmGCRA) {
+		return nil, fmt.Errorf("maxDelay is only supported by the redis backend, with the %s algorithm", AlgorithmGCRA)
+	}
+	// the reservations are made on the Redis limiter itself, bypassing the optimistic mode and the deny cache
+	if config.MaxDelay > 0 && (config.OptimisticBudget > 0 || config.DenyCacheSize > 0) {
+		return nil, fmt.Errorf("maxDelay cannot be used with optimisticBudget or denyCacheSize")
+	}
+	if config.ResponseCostHeader != "" {
+		if config.Backend != "redis" || config.Algorithm != AlgorithmGCRA {
+			return nil, fmt.Errorf("responseCostHeader is only supported by the redis backend, with the %s algorithm", AlgorithmGCRA)
+		}
+		if len(policies) > 0 || config.MaxDelay > 0 {
+			return nil, fmt.Errorf("responseCostHeader cannot be used with limits, policies or maxDelay")
+		}
+	}
+	if config.Quota < 0 {
+		return nil, fmt.Errorf("quota must be >=0. 0 means unlimited")
+	}
+	if config.Quota > 0 && config.Backend != "redis" {
+		return nil, fmt.Errorf("quota is only supported by the redis backend")
+	}
+	if config.Adaptive {
+		if config.Backend != "redis" {
+			return nil, fmt.Errorf("adaptive is only supported by the redis backend")
+		}
+		if config.Average == 0 {
+			return nil, fmt.Errorf("adaptive needs an average")
+		}
+		if config.AdaptiveFloor < 1 {
+			config.AdaptiveFloor = 10
+		}
+		if config.AdaptiveCeiling < 1 {
+			config.AdaptiveCeiling = 100
+		}
+		if config.AdaptiveFloor > config.AdaptiveCeiling {
+			return nil, fmt.Errorf("adaptiveFloor must be <= adaptiveCeiling")
+		}
+		if config.AdaptiveMaxErrorRate < 1 {
+			config.AdaptiveMaxErrorRate = 5
+		}
+		if config.AdaptiveMaxLatency < 0 {
+			return nil, fmt.Errorf("adaptiveMaxLatency must be >=0. 0 means disabled")
+		}
+		if config.AdaptiveLatencyPercentile < 1 || config.AdaptiveLatencyPercentile > 100 {
+			config.AdaptiveLatencyPercentile = 95
+		}
+		if config.AdaptiveInterval < 1 {
+			config.AdaptiveInterval = 10
+		}
+	}
+	if config.PenaltyThreshold < 0 {
+		return nil, fmt.Errorf("penaltyThreshold must be >=0. 0 means disabled")
+	}
+	if config.PenaltyThreshold > 0 {
+		if config.Backend != "redis" || config.Algorithm != AlgorithmGCRA {
+			return nil, fmt.Errorf("penaltyThreshold is only supported by the redis backend, with the %s algorithm", AlgorithmGCRA)
+		}
+		if len(policies) > 0 || config.MaxDelay > 0 || config.ResponseCostHeader != "" {
+			return nil, fmt.Errorf("penaltyThreshold cannot be used with limits, policies, maxDelay or responseCostHeader")
+		}
+	}
+	if config.PenaltyWindow < 1 {
+		config.PenaltyWindow = 60
+	}
+	if config.PenaltyDuration < 1 {
+		config.PenaltyDuration = 60
+	}
+	if config.PenaltyMaxDuration < 1 {
+		config.PenaltyMaxDuration = 3600
+	}
+	if config.PenaltyThreshold > 0 && config.PenaltyMaxDuration < config.PenaltyDuration {
+		return nil, fmt.Errorf("penaltyMaxDuration must be >= penaltyDuration")
+	}
+	refundStatuses, err := parseStatusRanges(config.RefundOnStatus)
+	if err != nil {
+		return nil, fmt.Errorf("invalid refundOnStatus: %v", err)
+	}
+	if len(refundStatuses) > 0 || len(config.RefundOnHeaders) > 0 {
+		if config.Backend != "redis" || config.Algorithm != AlgorithmGCRA {
+			return nil, fmt.Errorf("refundOnStatus/refundOnHeaders are only supported by the redis backend, with the %s algorithm", AlgorithmGCRA)
+		}
+		if len(policies) > 0 || config.ResponseCostHeader != "" {
+			return nil, fmt.Errorf("refundOnStatus/refundOnHeaders cannot be used with limits, policies or responseCostHeader")
+		}
+	}
+	if len(config.PriorityClasses) > 0 {
+		if config.Backend != "redis" || config.Algorithm != AlgorithmGCRA {
+			return nil, fmt.Errorf("priorityClasses are only supported by the redis backend, with the %s algorithm", AlgorithmGCRA)
+		}
+		// the denials of the low priority requests must not be applied to the other ones
+		if len(policies) > 0 || config.ResponseCostHeader != "" || config.DenyCacheSize > 0 || config.PenaltyThreshold > 0 {
+			return nil, fmt.Errorf("priorityClasses cannot be used with limits, policies, responseCostHeader, denyCacheSize or penaltyThreshold")
+		}
+		if err := validatePriorityClasses(config.PriorityClasses, config.Burst); err != nil {
+			return nil, err
+		}
+	}
+	if config.FairShare {
+		if config.Backend != "redis" {
+			return nil, fmt.Errorf("fairShare is only supported by the redis backend")
+		}
+		if config.Average == 0 {
+			return nil, fmt.Errorf("fairShare needs an average")
+		}
+		// the share of a source changes with the number of sources
+		if len(policies) > 0 || config.Tiers != nil || len(config.PriorityClasses) > 0 {
+			return nil, fmt.Errorf("fairShare cannot be used with limits, policies, tiers or priorityClasses")
+		}
+		if config.FairShareMin < 1 {
+			config.FairShareMin = 1
+		}
+		if config.FairShareMax < 1 {
+			config.FairShareMax = config.Average
+		}
+		if config.FairShareMin > config.FairShareMax {
+			return nil, fmt.Errorf("fairShareMin must be <= fairShareMax")
+		}
+		if config.FairShareWindow < 1 {
+			config.FairShareWindow = 10
+		}
+	}
+	distinctLimits, err := newDistinctLimits(config.DistinctLimits)
+	if err != nil {
+		return nil, err
+	}
+	if len(distinctLimits) > 0 && config.Backend != "redis" {
+		return nil, fmt.Errorf("distinctLimits are only supported by the redis backend")
+	}
+	failureStatuses, err := parseStatusRanges(config.FailureStatus)
+	if err != nil {
+		return nil, fmt.Errorf("invalid failureStatus: %v", err)
+	}
+	failureResets, err := parseStatusRanges(config.FailureResetStatus)
+	if err != nil {
+		return nil, fmt.Errorf("invalid failureResetStatus: %v", err)
+	}
+	if len(failureResets) > 0 && len(failureStatuses) == 0 {
+		return nil, fmt.Errorf("failureResetStatus needs a failureStatus")
+	}
+	if len(failureStatuses) > 0 {
+		if config.Backend != "redis" || config.Algorithm != AlgorithmGCRA {
+			return nil, fmt.Errorf("failureStatus is only supported by the redis backend, with the %s algorithm", AlgorithmGCRA)
+		}
+		if config.Average == 0 {
+			return nil, fmt.Errorf("failureStatus needs an average")
+		}
+		// the requests are not charged when they are let through
+		if len(policies) > 0 || config.ResponseCostHeader != "" || config.MaxDelay > 0 || len(refundStatuses) > 0 ||
+			len(config.RefundOnHeaders) > 0 || config.PenaltyThreshold > 0 || len(config.PriorityClasses) > 0 {
+			return nil, fmt.Errorf("failureStatus cannot be used with limits, policies, responseCostHeader, maxDelay, refundOnStatus/refundOnHeaders, penaltyThreshold or priorityClasses")
+		}
+	}
+	if config.Bandwidth < 0 {
+		return nil, fmt.Errorf("bandwidth must be >=0. 0 means unlimited")
+	}
+	if config.Bandwidth > 0 {
+		if config.Backend != "redis" || config.Algorithm != AlgorithmGCRA {
+			return nil, fmt.Errorf("bandwidth is only supported by the redis backend, with the %s algorithm", AlgorithmGCRA)
+		}
+		if config.BandwidthBurst < 1 {
+			config.BandwidthBurst = config.Bandwidth
+		}
+		if config.BandwidthChunk < 1 {
+			config.BandwidthChunk = 16384
+			if config.BandwidthChunk > config.BandwidthBurst {
+				config.BandwidthChunk = config.BandwidthBurst
+			}
+		}
+		if config.BandwidthChunk > config.BandwidthBurst {
+			return nil, fmt.Errorf("bandwidthChunk must be <= bandwidthBurst")
+		}
+	}
+	if config.MaxWaiting < 1 {
+		config.MaxWaiting = 100
+	}
+	if config.DenyCacheSize < 0 {
+		return nil, fmt.Errorf("denyCacheSize must be >=0. 0 means disabled")
+	}
 
 	// if the redis password starts with '$' like $REDIS_PASSWORD
 	// we read it from the environment variable
 	if len(config.RedisPassword) > 1 && config.RedisPassword[0] == '$' {
 		config.RedisPassword = os.Getenv(config.RedisPassword[1:])
 	}
+	if len(config.PeerSecret) > 1 && config.PeerSecret[0] == '$' {
+		config.PeerSecret = os.Getenv(config.PeerSecret[1:])
+	}
+	if config.Tiers != nil && len(config.Tiers.ClaimSecret) > 1 && config.Tiers.ClaimSecret[0] == '$' {
+		config.Tiers.ClaimSecret = os.Getenv(config.Tiers.ClaimSecret[1:])
+	}
 
 	sourceMatcher, err := utils.GetSourceExtractor(config.SourceCriterion)
 	if err != nil {
 		return nil, err
 	}
 
-	client, err := redis.NewClient(
-		config.RedisAddress,
-		config.RedisDB,
-		config.RedisPassword,
-		time.Duration(config.RedisConnectionTimeout)*time.Second,
-	)
+	// the smallest burst: a request costing more would never be allowed
+	maxCost := int64(0)
+	if config.Average > 0 {
+		maxCost = config.Burst
+	}
+	for _, p := range policies {
+		if maxCost == 0 || p.limit.Burst < maxCost {
+			maxCost = p.limit.Burst
+		}
+	}
+	if config.Tiers != nil {
+		for _, plan := range config.Tiers.Plans {
+			if plan.Burst > 0 && plan.Burst < maxCost {
+				maxCost = plan.Burst
+			}
+		}
+	}
+	costs, err := newCostResolver(config.CostRules, config.CostHeader, maxCost)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter, err := newRateLimiter(ctx, config, name)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create redis client: %v", err)
+		return nil, err
+	}
+	// the redis limiter, before being wrapped
+	redisLimiter, _ := limiter.(*Limiter)
+	if len(config.PriorityClasses) > 0 {
+		// the shared bucket is apart from the buckets of the sources
+		redisLimiter = redisLimiter.Priority()
+		limiter = redisLimiter
+	}
+
+	var t *tiers
+	if config.Tiers != nil {
+		t, err = newTiers(config.Tiers, redisLimiter)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// err = client.Ping()
-	// if err != nil {
-	// 	return nil, fmt.Errorf("error connecting to Redis: %v", err)
-	// }
+	var q *quota
+	if config.Quota > 0 {
+		q, err = newQuota(redisLimiter, config.Quota, config.QuotaPeriod, config.QuotaTimezone, config.QuotaAnchor)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	metrics := getMetrics(name)
+	if config.MetricsAddress != "" {
+		if err := startMetricsServer(config.MetricsAddress); err != nil {
+			return nil, err
+		}
+	}
+
+	var r *refund
+	if len(refundStatuses) > 0 || len(config.RefundOnHeaders) > 0 {
+		r = &refund{
+			limiter:  redisLimiter,
+			statuses: refundStatuses,
+			headers:  config.RefundOnHeaders,
+		}
+	}
+
+	var adaptive *adaptiveLimit
+	if config.Adaptive {
+		adaptive = newAdaptiveLimit(
+			ctx,
+			redisLimiter,
+			metrics,
+			float64(config.AdaptiveFloor)/100,
+			float64(config.AdaptiveCeiling)/100,
+			float64(config.AdaptiveMaxErrorRate)/100,
+			time.Duration(config.AdaptiveMaxLatency)*time.Millisecond,
+			float64(config.AdaptiveLatencyPercentile),
+			time.Duration(config.AdaptiveInterval)*time.Second,
+		)
+	}
+
+	var fl *failures
+	if len(failureStatuses) > 0 {
+		fl = &failures{
+			limiter:  redisLimiter,
+			statuses: failureStatuses,
+			resets:   failureResets,
+		}
+	}
+
+	var bw *bandwidth
+	if config.Bandwidth > 0 {
+		bw = &bandwidth{
+			limiter: redisLimiter,
+			limit: Limit{
+				Rate:   config.Bandwidth,
+				Burst:  config.BandwidthBurst,
+				Period: time.Second,
+			},
+			chunk: int(config.BandwidthChunk),
+		}
+	}
+
+	var f *fairShare
+	if config.FairShare {
+		f = newFairShare(
+			ctx,
+			redisLimiter,
+			metrics,
+			config.FairShareMin,
+			config.FairShareMax,
+			time.Duration(config.FairShareWindow)*time.Second,
+		)
+	}
+
+	if config.PenaltyThreshold > 0 {
+		limiter = NewPenaltyLimiter(redisLimiter, Penalty{
+			Threshold: config.PenaltyThreshold,
+			Window:    time.Duration(config.PenaltyWindow) * time.Second,
+			Ban:       time.Duration(config.PenaltyDuration) * time.Second,
+			MaxBan:    time.Duration(config.PenaltyMaxDuration) * time.Second,
+		}, metrics)
+	}
+	if config.OptimisticBudget > 0 {
+		limiter = NewOptimisticLimiter(limiter, time.Duration(config.OptimisticBudget)*time.Millisecond, metrics)
+	}
+	if config.DenyCacheSize > 0 {
+		limiter = NewDenyCacheLimiter(limiter, int(config.DenyCacheSize), metrics)
+	}
 
 	return &ClusterRateLimit{
 		next:          next,
-		limiter:       NewLimiter(client, name, config.BreakerThreshold, config.BreakerReattempt),
+		limiter:       limiter,
 		name:          name,
 		average:       config.Average,
 		burst:         config.Burst,
 		period:        config.Period,
+		policies:      policies,
+		headers:       config.Headers,
 		sourceMatcher: sourceMatcher,
+		costs:         costs,
+		redis:         redisLimiter,
+
+		responseCostHeader: config.ResponseCostHeader,
+
+		quota:    q,
+		adaptive: adaptive,
+		refund:   r,
+
+		priorityClasses: config.PriorityClasses,
+		tiers:           t,
+		fairShare:       f,
+
+		distinctLimits: distinctLimits,
+
+		failures:  fl,
+		bandwidth: bw,
+
+		maxConcurrent:    config.MaxConcurrent,
+		concurrencyLease: time.Duration(config.ConcurrencyLease) * time.Second,
+
+		maxDelay: time.Duration(config.MaxDelay) * time.Millisecond,
+		waiting:  make(chan struct{}, config.MaxWaiting),
 	}, nil
 }
 
+// newRateLimiter creates the RateLimiter of the configured backend
+func newRateLimiter(ctx context.Context, config *Config, name string) (RateLimiter, error) {
+	switch config.Backend {
+	case "redis":
+		client, err := redis.NewClient(
+			config.RedisAddress,
+			config.RedisDB,
+			config.RedisPassword,
+			time.Duration(config.RedisConnectionTimeout)*time.Second,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create redis client: %v", err)
+		}
+
+		// err = client.Ping()
+		// if err != nil {
+		// 	return nil, fmt.Errorf("error connecting to Redis: %v", err)
+		// }
+
+		limiter, err := NewLimiter(client, name, config.Algorithm, config.BreakerThreshold, config.BreakerReattempt)
+		if err != nil {
+			return nil, err
+		}
+		if config.WindowTimezone != "" {
+			location, err := time.LoadLocation(config.WindowTimezone)
+			if err != nil {
+				return nil, fmt.Errorf("invalid windowTimezone: %v", err)
+			}
+			limiter.SetLocation(location)
+		}
+		return limiter, nil
+	case "memcached":
+		client, err := memcached.NewClient(
+			config.MemcachedAddress,
+			time.Duration(config.RedisConnectionTimeout)*time.Second,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create memcached client: %v", err)
+		}
+		return NewMemcachedLimiter(client, name, config.BreakerThreshold, config.BreakerReattempt), nil
+	case "peers":
+		var resolver peers.Resolver
+		switch {
+		case config.PeersDNS != "":
+			dnsResolver, err := peers.NewDNSResolver(config.PeersDNS)
+			if err != nil {
+				return nil, err
+			}
+			resolver = dnsResolver
+		case len(config.Peers) > 0:
+			resolver = &peers.StaticResolver{Peers: config.Peers}
+		default:
+			return nil, fmt.Errorf("the peers backend needs either peers or peersDns")
+		}
+		// anyone reaching the peer listener could use it otherwise
+		if config.PeerSecret == "" {
+			return nil, fmt.Errorf("the peers backend needs a peerSecret")
+		}
+		return NewPeerLimiter(
+			ctx,
+			name,
+			config.PeerListenAddress,
+			config.PeerSecret,
+			resolver,
+			time.Duration(config.PeerTimeout)*time.Millisecond,
+			time.Duration(config.PeerRefresh)*time.Second,
+		)
+	case "rls":
+		if config.RLSDomain == "" {
+			return nil, fmt.Errorf("the rls backend needs a rlsDomain")
+		}
+		return NewRLSLimiter(
+			config.RLSAddress,
+			config.RLSDomain,
+			config.RLSSourceKey,
+			config.RLSDescriptorEntries,
+			time.Duration(config.RedisConnectionTimeout)*time.Second,
+			config.BreakerThreshold,
+			config.BreakerReattempt,
+		), nil
+	}
+	return nil, fmt.Errorf("unknown backend %q", config.Backend)
+}
+
 func (rl *ClusterRateLimit) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// cf https://medium.com/@bingolbalihasan/redis-rate-limiting-in-go-d342bab3d930
 
 	// average = 0 means unlimited
-	if rl.average == 0 {
+	if rl.average == 0 && len(rl.policies) == 0 && rl.quota == nil && len(rl.distinctLimits) == 0 && rl.maxConcurrent == 0 && rl.bandwidth == nil {
 		rl.next.ServeHTTP(rw, req)
 		return
 	}
 
-	source, _, err := rl.sourceMatcher.Extract(req)
+	source, amount, err := rl.sourceMatcher.Extract(req)
 	if err != nil {
 		//logger.Error().Err(err).Msg("Could not extract source of request")
 		http.Error(rw, "could not extract source of request", http.StatusInternalServerError)
 		return
 	}
 
-	res, err := rl.limiter.Allow(source, Limit{
-		Rate:   rl.average,
-		Burst:  rl.burst,
-		Period: time.Duration(rl.period) * time.Second,
-	})
-	if err != nil {
-		rl.next.ServeHTTP(rw, req)
-	} else {
-		if res.Allowed <= 0 {
-			retryAfter := int64(res.RetryAfter/time.Second) + 1
-			rw.Header().Set("retry-after", fmt.Sprintf("%d", retryAfter))
+	cost := rl.costs.cost(req, amount)
+	// what was consumed, to be refunded
+	charged := 0
+	if rl.responseCostHeader != "" && rl.average > 0 {
+		// the cost is charged once the upstream answered
+		if !rl.checkQuota(rw, req, source) {
+			return
+		}
+	} else if rl.average > 0 || len(rl.policies) > 0 {
+		res, policyName, doneWaiting, err := rl.allow(req, source, int(cost))
+		// on error, we let pass through
+		if err == nil {
+			if rl.headers {
+				setRateLimitHeaders(rw, res)
+				if rl.adaptive != nil {
+					rw.Header().Set("X-RateLimit-Factor", fmt.Sprintf("%g", rl.adaptive.currentFactor()))
+				}
+			}
+			if res.Allowed <= 0 {
+				if policyName != "" {
+					rw.Header().Set("X-RateLimit-Policy", policyName)
+				}
+				rw.Header().Set("retry-after", retryAfterHeader(res.RetryAfter))
+				http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			charged = res.Allowed
+			if res.Delay > 0 {
+				awake := sleep(req.Context(), res.Delay)
+				doneWaiting()
+				if !awake {
+					// the client is gone
+					return
+				}
+			}
+		}
+	}
+
+	if rl.quota != nil {
+		res, err := rl.quota.allowN(source, int(cost))
+		// on error, we let pass through
+		if err == nil {
+			setQuotaHeaders(rw, res)
+			if res.Allowed <= 0 {
+				rw.Header().Set("retry-after", retryAfterHeader(res.RetryAfter))
+				http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+		}
+	}
+
+	if res, name := rl.allowDistinct(req); res != nil {
+		rw.Header().Set("X-RateLimit-Policy", name)
+		rw.Header().Set("retry-after", retryAfterHeader(res.RetryAfter))
+		http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	if rl.maxConcurrent > 0 {
+		release, acquired := rl.acquireSlot(source)
+		if !acquired {
+			rw.Header().Set("retry-after", "1")
 			http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
 			return
 		}
+		defer release()
+	}
 
-		rl.next.ServeHTTP(rw, req)
+	if rl.bandwidth != nil {
+		w, release := rl.bandwidth.wrap(rw, req, source)
+		defer release()
+		rw = w
+	}
+
+	if rl.adaptive != nil || rl.refund != nil && charged > 0 || rl.failures != nil {
+		start := time.Now()
+		w := &statusResponseWriter{ResponseWriter: rw}
+		defer func() {
+			if rl.adaptive != nil {
+				rl.adaptive.record(w.status, time.Since(start))
+			}
+			if rl.refund != nil && charged > 0 && rl.refund.refunded(w.status, w.Header()) {
+				rl.refund.limiter.RefundN(rl.bucket(source), rl.limit(req, source), charged)
+			}
+			if rl.failures != nil {
+				rl.failures.record(source, rl.limit(req, source), charged, w.status)
+			}
+		}()
+		rw = w
+	}
+
+	if rl.responseCostHeader != "" && rl.average > 0 {
+		rl.serveAndCharge(rw, req, source, cost)
+		return
+	}
+	rl.next.ServeHTTP(rw, req)
+}
+
+// setRateLimitHeaders reports the state of the limiter to the client
+func setRateLimitHeaders(rw http.ResponseWriter, res *Result) {
+	resetAt := res.ResetAt
+	if resetAt.IsZero() {
+		resetAt = time.Now().Add(res.ResetAfter)
+	}
+	// round up, to not tell the client to come back too early
+	reset := resetAt.Unix()
+	if resetAt.Nanosecond() > 0 {
+		reset++
+	}
+
+	rw.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", res.Limit.Rate))
+	rw.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", res.Remaining))
+	rw.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", reset))
+	if res.Limit.Tier != "" {
+		rw.Header().Set("X-RateLimit-Tier", res.Limit.Tier)
+	}
+}
+
+// retryAfterHeader returns the retry-after header value, in seconds, rounded
+// up to not tell the client to come back too early
+func retryAfterHeader(retryAfter time.Duration) string {
+	seconds := int64(retryAfter / time.Second)
+	if retryAfter%time.Second > 0 || seconds < 1 {
+		seconds++
+	}
+	return fmt.Sprintf("%d", seconds)
+}
+
+// randomID returns a random identifier
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
 	}
+	return hex.EncodeToString(b)
 }
@@ -0,0 +1,70 @@
+package traefik_cluster_ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestMiddleware returns the middleware in front of next, using a
+// miniredis server
+func newTestMiddleware(t *testing.T, config *Config, next http.HandlerFunc) (*ClusterRateLimit, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	config.RedisAddress = server.Addr()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	handler, err := New(ctx, next, config, t.Name())
+	require.NoError(t, err)
+	return handler.(*ClusterRateLimit), server
+}
+
+func TestNewAlgorithm(t *testing.T) {
+	for _, config := range []*Config{
+		{Average: 10, Burst: 10, Algorithm: "leaky-bucket"},
+		{Average: 10, Burst: 10, Algorithm: AlgorithmSlidingLog, Backend: "memcached"},
+		{Average: 10, Burst: 10, Algorithm: AlgorithmSlidingWindow, WindowTimezone: "Europe/Paris"},
+		{Average: 10, Burst: 10, Algorithm: AlgorithmFixedWindow, WindowTimezone: "Mars/Olympus"},
+	} {
+		_, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+		assert.Error(t, err, config)
+	}
+
+	for _, algorithm := range []string{AlgorithmGCRA, AlgorithmSlidingLog, AlgorithmSlidingWindow, AlgorithmFixedWindow} {
+		rl, _ := newTestMiddleware(t, &Config{Average: 10, Burst: 10, Algorithm: algorithm}, nil)
+		assert.Equal(t, algorithm, rl.limiter.(*Limiter).algorithm)
+	}
+}
+
+func TestSetRateLimitHeaders(t *testing.T) {
+	limit := Limit{Rate: 10, Burst: 20, Period: time.Second}
+
+	// the reset of a fixed window is on the boundary
+	rw := httptest.NewRecorder()
+	setRateLimitHeaders(rw, &Result{Limit: limit, Remaining: 4, ResetAt: time.Unix(1700000060, 0)})
+	assert.Equal(t, "10", rw.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "4", rw.Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "1700000060", rw.Header().Get("X-RateLimit-Reset"))
+	assert.Empty(t, rw.Header().Get("X-RateLimit-Tier"))
+
+	// rounded up
+	rw = httptest.NewRecorder()
+	setRateLimitHeaders(rw, &Result{Limit: limit, ResetAt: time.Unix(1700000060, 1)})
+	assert.Equal(t, "1700000061", rw.Header().Get("X-RateLimit-Reset"))
+
+	// otherwise, relative to now
+	rw = httptest.NewRecorder()
+	limit.Tier = "gold"
+	setRateLimitHeaders(rw, &Result{Limit: limit, ResetAfter: time.Minute})
+	reset, err := strconv.ParseInt(rw.Header().Get("X-RateLimit-Reset"), 10, 64)
+	require.NoError(t, err)
+	assert.InDelta(t, time.Now().Add(time.Minute).Unix(), reset, 2)
+	assert.Equal(t, "gold", rw.Header().Get("X-RateLimit-Tier"))
+}
@@ -0,0 +1,73 @@
+package traefik_cluster_ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// statusRange is an inclusive range of HTTP status codes
+type statusRange struct {
+	from int
+	to   int
+}
+
+// statusRanges matches HTTP status codes
+type statusRanges []statusRange
+
+// parseStatusRanges parses a list of status codes ("503") or ranges ("500-599")
+func parseStatusRanges(values []string) (statusRanges, error) {
+	ranges := make(statusRanges, 0, len(values))
+	for _, value := range values {
+		from, to, isRange := strings.Cut(strings.TrimSpace(value), "-")
+		r := statusRange{}
+		var err error
+		if r.from, err = strconv.Atoi(strings.TrimSpace(from)); err != nil {
+			return nil, fmt.Errorf("invalid status %q", value)
+		}
+		r.to = r.from
+		if isRange {
+			if r.to, err = strconv.Atoi(strings.TrimSpace(to)); err != nil {
+				return nil, fmt.Errorf("invalid status range %q", value)
+			}
+		}
+		if r.from < 100 || r.to > 599 || r.from > r.to {
+			return nil, fmt.Errorf("invalid status range %q", value)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func (ranges statusRanges) contains(status int) bool {
+	for _, r := range ranges {
+		if status >= r.from && status <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// refund gives the cost of the requests back, when the upstream failed
+type refund struct {
+	limiter  *Limiter
+	statuses statusRanges
+	headers  []string
+}
+
+// refunded reports whether the response of the upstream is to be refunded
+func (r *refund) refunded(status int, header http.Header) bool {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if r.statuses.contains(status) {
+		return true
+	}
+	for _, name := range r.headers {
+		if header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
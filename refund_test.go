@@ -0,0 +1,72 @@
+package traefik_cluster_ratelimit
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusRanges(t *testing.T) {
+	ranges, err := parseStatusRanges([]string{"429", "500-503", " 504 "})
+	require.NoError(t, err)
+	assert.True(t, ranges.contains(429))
+	assert.True(t, ranges.contains(502))
+	assert.True(t, ranges.contains(504))
+	assert.False(t, ranges.contains(200))
+	assert.False(t, ranges.contains(505))
+
+	for _, invalid := range []string{"abc", "500-", "503-500", "42", "500-600"} {
+		_, err := parseStatusRanges([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestRefunded(t *testing.T) {
+	ranges, err := parseStatusRanges([]string{"502-503"})
+	require.NoError(t, err)
+	r := &refund{statuses: ranges, headers: []string{"X-Upstream-Overloaded"}}
+
+	assert.True(t, r.refunded(http.StatusServiceUnavailable, http.Header{}))
+	assert.False(t, r.refunded(0, http.Header{}))
+	assert.False(t, r.refunded(http.StatusInternalServerError, http.Header{}))
+
+	header := http.Header{}
+	header.Set("X-Upstream-Overloaded", "1")
+	assert.True(t, r.refunded(http.StatusOK, header))
+}
+
+func TestLimiterRefundN(t *testing.T) {
+	limiter, server := newTestLimiter(t, AlgorithmGCRA)
+	limit := Limit{Rate: 1, Burst: 2, Period: time.Minute}
+	allowed := func(key string) int {
+		res, err := limiter.AllowN(key, limit, 1)
+		require.NoError(t, err)
+		return res.Allowed
+	}
+
+	assert.Equal(t, 1, allowed("1.2.3.4"))
+	assert.Equal(t, 1, allowed("1.2.3.4"))
+	assert.Equal(t, 0, allowed("1.2.3.4"))
+
+	// the refunded request can be made again
+	require.NoError(t, limiter.RefundN("1.2.3.4", limit, 1))
+	assert.Equal(t, 1, allowed("1.2.3.4"))
+	assert.Equal(t, 0, allowed("1.2.3.4"))
+
+	// refunding more than was consumed gives no extra burst
+	require.NoError(t, limiter.RefundN("1.2.3.4", limit, 5))
+	assert.False(t, server.Exists("rate_test1.2.3.4"))
+	assert.Equal(t, 1, allowed("1.2.3.4"))
+	assert.Equal(t, 1, allowed("1.2.3.4"))
+	assert.Equal(t, 0, allowed("1.2.3.4"))
+
+	// nor does a refund of a fresh key
+	require.NoError(t, limiter.RefundN("5.6.7.8", limit, 5))
+	assert.False(t, server.Exists("rate_test5.6.7.8"))
+	assert.Equal(t, 1, allowed("5.6.7.8"))
+	assert.Equal(t, 1, allowed("5.6.7.8"))
+	assert.Equal(t, 0, allowed("5.6.7.8"))
+}
@@ -0,0 +1,117 @@
+package traefik_cluster_ratelimit
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// costResponseWriter reads (and removes) the cost reported by the upstream,
+// in a response header or trailer
+type costResponseWriter struct {
+	http.ResponseWriter
+	header      string
+	cost        int64
+	wroteHeader bool
+	hijacked    bool
+}
+
+// readCost takes the cost from the headers, or from the trailers once the
+// upstream is done. The header is removed, so that it is not sent to the client
+func (w *costResponseWriter) readCost() {
+	for _, name := range []string{w.header, http.TrailerPrefix + w.header} {
+		value := w.ResponseWriter.Header().Get(name)
+		if value == "" {
+			continue
+		}
+		w.ResponseWriter.Header().Del(name)
+		if cost, err := strconv.ParseInt(value, 10, 64); err == nil && cost >= 0 {
+			w.cost = cost
+		}
+	}
+}
+
+func (w *costResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.readCost()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *costResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps the streamed responses working
+func (w *costResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack keeps the websockets working. The hijacked connections are charged
+// the cost of the request: the upstream answers on the raw connection, so no
+// cost can be reported in the response
+func (w *costResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T is not a http.Hijacker", w.ResponseWriter)
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap is used by http.ResponseController
+func (w *costResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// checkQuota rejects the request if the source has no quota left (because of
+// its debt), without consuming anything. It returns false if it was rejected
+func (rl *ClusterRateLimit) checkQuota(rw http.ResponseWriter, req *http.Request, source string) bool {
+	res, err := rl.redis.Check(source, rl.limit(req, source))
+	// on error, we let pass through
+	if err != nil {
+		return true
+	}
+	if rl.headers {
+		setRateLimitHeaders(rw, res)
+	}
+	if res.Allowed <= 0 {
+		rw.Header().Set("retry-after", retryAfterHeader(res.RetryAfter))
+		http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// serveAndCharge lets the request through, and then charges the cost reported
+// by the upstream (or the cost of the request, if none is reported), going
+// into debt if needed
+func (rl *ClusterRateLimit) serveAndCharge(rw http.ResponseWriter, req *http.Request, source string, cost int64) {
+	w := &costResponseWriter{
+		ResponseWriter: rw,
+		header:         rl.responseCostHeader,
+		cost:           cost,
+	}
+	rl.next.ServeHTTP(w, req)
+	if !w.hijacked {
+		w.readCost()
+	}
+
+	if w.cost > 0 {
+		rl.redis.ChargeN(source, rl.limit(req, source), int(w.cost))
+	}
+}
@@ -0,0 +1,88 @@
+package traefik_cluster_ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCostResponseWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &costResponseWriter{ResponseWriter: rec, header: "X-RateLimit-Cost", cost: 1}
+	w.Header().Set("X-RateLimit-Cost", "42")
+	w.Write([]byte("hello"))
+	w.readCost()
+	assert.Equal(t, int64(42), w.cost)
+	assert.Empty(t, rec.Header().Get("X-RateLimit-Cost"))
+
+	// as a trailer
+	rec = httptest.NewRecorder()
+	w = &costResponseWriter{ResponseWriter: rec, header: "X-RateLimit-Cost", cost: 1}
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set(http.TrailerPrefix+"X-RateLimit-Cost", "7")
+	w.readCost()
+	assert.Equal(t, int64(7), w.cost)
+	assert.Empty(t, rec.Header().Get(http.TrailerPrefix+"X-RateLimit-Cost"))
+
+	// the cost of the request is kept when the upstream doesn't report one
+	rec = httptest.NewRecorder()
+	w = &costResponseWriter{ResponseWriter: rec, header: "X-RateLimit-Cost", cost: 3}
+	w.Write([]byte("hello"))
+	w.readCost()
+	assert.Equal(t, int64(3), w.cost)
+}
+
+func TestCostResponseWriterHijack(t *testing.T) {
+	// the recorder cannot be hijacked
+	rec := httptest.NewRecorder()
+	w := &costResponseWriter{ResponseWriter: rec, header: "X-RateLimit-Cost", cost: 1}
+	_, _, err := w.Hijack()
+	assert.Error(t, err)
+	assert.False(t, w.hijacked)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		w := &costResponseWriter{ResponseWriter: rw, header: "X-RateLimit-Cost", cost: 1}
+		conn, _, err := w.Hijack()
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+		assert.True(t, w.hijacked)
+	}))
+	defer server.Close()
+	_, err = http.Get(server.URL)
+	assert.Error(t, err)
+}
+
+func TestResponseCost(t *testing.T) {
+	rl, server := newTestMiddleware(t, &Config{Average: 10, Burst: 10, ResponseCostHeader: "X-RateLimit-Cost"},
+		func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("X-RateLimit-Cost", "25")
+			rw.Write([]byte("ok"))
+		})
+	now := time.Now()
+	server.SetTime(now)
+
+	serve := func() *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		rl.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rw
+	}
+
+	// let through with some quota left, and charged 25: 15 requests in debt
+	rw := serve()
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "ok", rw.Body.String())
+	assert.Empty(t, rw.Header().Get("X-RateLimit-Cost"))
+
+	rw = serve()
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	server.SetTime(now.Add(time.Second))
+	assert.Equal(t, http.StatusTooManyRequests, serve().Code)
+
+	// the debt is repaid
+	server.SetTime(now.Add(2 * time.Second))
+	assert.Equal(t, http.StatusOK, serve().Code)
+}
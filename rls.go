@@ -0,0 +1,207 @@
+package traefik_cluster_ratelimit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nzin/traefik-cluster-ratelimit/internal/breaker"
+)
+
+// RLSEntry is a descriptor entry sent to the rate limit service
+type RLSEntry struct {
+	Key   string `json:"key" yaml:"key"`
+	Value string `json:"value" yaml:"value"`
+}
+
+type rlsDescriptor struct {
+	Entries []RLSEntry `json:"entries"`
+}
+
+type rlsRequest struct {
+	Domain      string          `json:"domain"`
+	Descriptors []rlsDescriptor `json:"descriptors"`
+	HitsAddend  int             `json:"hits_addend,omitempty"`
+}
+
+type rlsRateLimit struct {
+	RequestsPerUnit int64  `json:"requestsPerUnit"`
+	Unit            string `json:"unit"`
+}
+
+type rlsStatus struct {
+	Code               string        `json:"code"`
+	CurrentLimit       *rlsRateLimit `json:"currentLimit"`
+	LimitRemaining     int64         `json:"limitRemaining"`
+	DurationUntilReset string        `json:"durationUntilReset"`
+}
+
+type rlsResponse struct {
+	OverallCode string      `json:"overallCode"`
+	Statuses    []rlsStatus `json:"statuses"`
+}
+
+// RLSLimiter delegates the decisions to a Lyft/Envoy-style global rate limit
+// service (RLS), using its HTTP/JSON API. The limits are the ones configured in
+// the RLS: the Limit given to AllowN is only reported when no RLS rule matches.
+type RLSLimiter struct {
+	client  *http.Client
+	url     string
+	domain  string
+	key     string
+	entries []RLSEntry
+	breaker *breaker.Breaker
+}
+
+// NewRLSLimiter returns a new RLSLimiter. Each descriptor is made of the extra
+// entries, the tier of the limit (as "tier", if any), followed by the extracted
+// source (as sourceKey).
+func NewRLSLimiter(
+	address string,
+	domain string,
+	sourceKey string,
+	entries []RLSEntry,
+	timeout time.Duration,
+	breakerThreshold, breakerReattempt int64,
+) *RLSLimiter {
+	return &RLSLimiter{
+		client:  &http.Client{Timeout: timeout},
+		url:     strings.TrimSuffix(address, "/") + "/json",
+		domain:  domain,
+		key:     sourceKey,
+		entries: entries,
+		breaker: breaker.NewBreaker(breakerThreshold, breakerReattempt),
+	}
+}
+
+// AllowN reports whether n events may happen at time now.
+func (l *RLSLimiter) AllowN(key string, limit Limit, n int) (*Result, error) {
+	res, err := l.breaker.Run(func() (interface{}, error) {
+		return l.shouldRateLimit(key, limit, n)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*Result), nil
+}
+
+func (l *RLSLimiter) shouldRateLimit(key string, limit Limit, n int) (*Result, error) {
+	entries := make([]RLSEntry, 0, len(l.entries)+2)
+	entries = append(entries, l.entries...)
+	if limit.Tier != "" {
+		entries = append(entries, RLSEntry{Key: "tier", Value: limit.Tier})
+	}
+	entries = append(entries, RLSEntry{Key: l.key, Value: key})
+
+	body, err := json.Marshal(&rlsRequest{
+		Domain:      l.domain,
+		Descriptors: []rlsDescriptor{{Entries: entries}},
+		HitsAddend:  n,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := l.client.Post(l.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// the RLS answers 429 when the overall code is OVER_LIMIT
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusTooManyRequests {
+		return nil, fmt.Errorf("rate limit service answered %d: %s", resp.StatusCode, body)
+	}
+
+	var r rlsResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("invalid rate limit service response: %v", err)
+	}
+	return rlsResult(&r, limit, n)
+}
+
+// rlsResult converts a RLS response into a Result
+func rlsResult(r *rlsResponse, limit Limit, n int) (*Result, error) {
+	res := &Result{
+		Limit:      limit,
+		Allowed:    n,
+		Remaining:  int(limit.Burst),
+		RetryAfter: -1,
+		ResetAfter: 0,
+	}
+
+	switch r.OverallCode {
+	case "OK":
+	case "OVER_LIMIT":
+		res.Allowed = 0
+	default:
+		return nil, fmt.Errorf("unexpected rate limit service code %q", r.OverallCode)
+	}
+
+	if len(r.Statuses) == 0 {
+		return res, nil
+	}
+	status := r.Statuses[0]
+
+	if status.CurrentLimit != nil {
+		period, err := rlsUnitDuration(status.CurrentLimit.Unit)
+		if err != nil {
+			return nil, err
+		}
+		res.Limit = Limit{
+			Rate:   status.CurrentLimit.RequestsPerUnit,
+			Burst:  status.CurrentLimit.RequestsPerUnit,
+			Period: period,
+		}
+		res.Remaining = int(status.LimitRemaining)
+	}
+
+	if status.DurationUntilReset != "" {
+		resetAfter, err := time.ParseDuration(status.DurationUntilReset)
+		if err != nil {
+			return nil, fmt.Errorf("invalid durationUntilReset %q: %v", status.DurationUntilReset, err)
+		}
+		res.ResetAfter = resetAfter
+	}
+
+	if res.Allowed == 0 {
+		res.Remaining = 0
+		res.RetryAfter = res.ResetAfter
+	}
+	return res, nil
+}
+
+func rlsUnitDuration(unit string) (time.Duration, error) {
+	switch unit {
+	case "SECOND":
+		return time.Second, nil
+	case "MINUTE":
+		return time.Minute, nil
+	case "HOUR":
+		return time.Hour, nil
+	case "DAY":
+		return 24 * time.Hour, nil
+	case "WEEK":
+		return 7 * 24 * time.Hour, nil
+	case "MONTH":
+		return 30 * 24 * time.Hour, nil
+	case "YEAR":
+		return 365 * 24 * time.Hour, nil
+	}
+	return 0, fmt.Errorf("unknown rate limit unit %q", unit)
+}
+
+// Reset is not supported by the rate limit service API
+func (l *RLSLimiter) Reset(ctx context.Context, key string) error {
+	return errors.New("reset is not supported by the rate limit service")
+}
@@ -0,0 +1,70 @@
+package traefik_cluster_ratelimit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRLSLimiter(t *testing.T) {
+	var received rlsRequest
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/json", req.URL.Path)
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&received))
+
+		entries := received.Descriptors[0].Entries
+		if entries[len(entries)-1].Value == "1.2.3.4" {
+			rw.WriteHeader(http.StatusTooManyRequests)
+			rw.Write([]byte(`{"overallCode":"OVER_LIMIT","statuses":[{"code":"OVER_LIMIT","currentLimit":{"requestsPerUnit":10,"unit":"MINUTE"},"durationUntilReset":"12s"}]}`))
+			return
+		}
+		if entries[len(entries)-1].Value == "5.6.7.8" {
+			rw.Write([]byte(`{"overallCode":"OK","statuses":[{"code":"OK","currentLimit":{"requestsPerUnit":100,"unit":"HOUR"},"limitRemaining":42,"durationUntilReset":"0.500s"}]}`))
+			return
+		}
+		// no rule matching
+		rw.Write([]byte(`{"overallCode":"OK","statuses":[{"code":"OK"}]}`))
+	}))
+	defer server.Close()
+
+	limiter := NewRLSLimiter(server.URL, "traefik", "remote_address", []RLSEntry{{Key: "generic_key", Value: "api"}}, time.Second, 3, 15)
+	limit := Limit{Rate: 5, Burst: 5, Period: time.Second}
+
+	t.Run("over limit", func(t *testing.T) {
+		res, err := limiter.AllowN("1.2.3.4", limit, 1)
+		require.NoError(t, err)
+		assert.Equal(t, "traefik", received.Domain)
+		assert.Equal(t, []RLSEntry{{Key: "generic_key", Value: "api"}, {Key: "remote_address", Value: "1.2.3.4"}}, received.Descriptors[0].Entries)
+		assert.Equal(t, 1, received.HitsAddend)
+
+		assert.Equal(t, 0, res.Allowed)
+		assert.Equal(t, 0, res.Remaining)
+		assert.Equal(t, Limit{Rate: 10, Burst: 10, Period: time.Minute}, res.Limit)
+		assert.Equal(t, 12*time.Second, res.RetryAfter)
+		assert.Equal(t, 12*time.Second, res.ResetAfter)
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		res, err := limiter.AllowN("5.6.7.8", limit, 3)
+		require.NoError(t, err)
+		assert.Equal(t, 3, received.HitsAddend)
+
+		assert.Equal(t, 3, res.Allowed)
+		assert.Equal(t, 42, res.Remaining)
+		assert.Equal(t, Limit{Rate: 100, Burst: 100, Period: time.Hour}, res.Limit)
+		assert.Equal(t, time.Duration(-1), res.RetryAfter)
+		assert.Equal(t, 500*time.Millisecond, res.ResetAfter)
+	})
+
+	t.Run("no rule matching", func(t *testing.T) {
+		res, err := limiter.AllowN("9.9.9.9", limit, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 1, res.Allowed)
+		assert.Equal(t, limit, res.Limit)
+	})
+}
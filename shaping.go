@@ -0,0 +1,42 @@
+package traefik_cluster_ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// allowOrReserve decides whether the request may happen now. When a waiting
+// slot is available, the request may also be delayed up to maxDelay (its
+// tokens are then reserved), instead of being rejected.
+func (rl *ClusterRateLimit) allowOrReserve(source string, limit Limit, n int) (*Result, func(), error) {
+	if rl.maxDelay > 0 {
+		select {
+		case rl.waiting <- struct{}{}:
+			res, err := rl.redis.ReserveN(source, limit, n, rl.maxDelay)
+			if err != nil || res.Delay <= 0 {
+				<-rl.waiting
+				return res, func() {}, err
+			}
+			return res, func() { <-rl.waiting }, nil
+		default:
+			// too many requests are already waiting
+		}
+	}
+
+	res, err := rl.limiter.AllowN(source, limit, n)
+	return res, func() {}, err
+}
+
+// sleep waits for the given delay, unless the request is cancelled first.
+// It returns false if the request was cancelled.
+func sleep(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
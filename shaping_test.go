@@ -0,0 +1,63 @@
+package traefik_cluster_ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowOrReserve(t *testing.T) {
+	rl, server := newTestMiddleware(t, &Config{Average: 1, Burst: 1, MaxDelay: 1500, MaxWaiting: 1}, nil)
+	server.SetTime(time.Now())
+	limit := Limit{Rate: 1, Burst: 1, Period: time.Second}
+
+	res, doneWaiting, err := rl.allowOrReserve("source", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Allowed)
+	assert.Zero(t, res.Delay)
+	assert.Len(t, rl.waiting, 0)
+	doneWaiting()
+
+	// the next token is reserved, one second later
+	res, doneWaiting, err = rl.allowOrReserve("source", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Allowed)
+	assert.InDelta(t, time.Second, res.Delay, float64(10*time.Millisecond))
+	assert.Len(t, rl.waiting, 1)
+
+	// no waiting slot left: rejected without being delayed
+	res, _, err = rl.allowOrReserve("source", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Allowed)
+	doneWaiting()
+	assert.Len(t, rl.waiting, 0)
+
+	// two seconds is more than the maximum delay
+	res, doneWaiting, err = rl.allowOrReserve("source", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Allowed)
+	assert.Len(t, rl.waiting, 0)
+	doneWaiting()
+}
+
+func TestSleep(t *testing.T) {
+	assert.True(t, sleep(context.Background(), time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, sleep(ctx, time.Minute))
+}
+
+func TestMaxDelayConflicts(t *testing.T) {
+	// the reservations would bypass the optimistic mode and the deny cache
+	for _, config := range []*Config{
+		{Average: 1, Burst: 1, MaxDelay: 500, OptimisticBudget: 5, Backend: "redis", Algorithm: AlgorithmGCRA},
+		{Average: 1, Burst: 1, MaxDelay: 500, DenyCacheSize: 100, Backend: "redis", Algorithm: AlgorithmGCRA},
+	} {
+		_, err := New(context.Background(), nil, config, t.Name())
+		assert.EqualError(t, err, "maxDelay cannot be used with optimisticBudget or denyCacheSize")
+	}
+}
@@ -0,0 +1,324 @@
+package traefik_cluster_ratelimit
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the maximum number of entries of the cache of the Redis lookups
+const tiersCacheSize = 10000
+
+// TierPlan is the limit of a tier
+type TierPlan struct {
+	Average int64 `json:"average" yaml:"average"`
+	Burst   int64 `json:"burst" yaml:"burst"`
+	// Period, in seconds, defaults to a second
+	Period int64 `json:"period,omitempty" yaml:"period,omitempty"`
+}
+
+// TiersConfig maps the clients to named plans (tiers), each with its own limit
+type TiersConfig struct {
+	// HeaderName is the request header identifying the client (like an API key)
+	HeaderName string `json:"headerName,omitempty" yaml:"headerName,omitempty"`
+	// Claim identifies the client with a claim of the JWT bearer token of the
+	// Authorization header. The token is only verified with ClaimSecret: otherwise
+	// it must have been verified by a previous middleware
+	Claim string `json:"claim,omitempty" yaml:"claim,omitempty"`
+	// ClaimSecret verifies the HS256 signature (and the expiry) of the JWT bearer
+	// token. If it starts with '$' like $JWT_SECRET, it is read from the environment
+	ClaimSecret string `json:"claimSecret,omitempty" yaml:"claimSecret,omitempty"`
+	// Plans are the limits of the tiers, by name
+	Plans map[string]TierPlan `json:"plans,omitempty" yaml:"plans,omitempty"`
+	// Default is the tier of the clients without a known tier
+	Default string `json:"default,omitempty" yaml:"default,omitempty"`
+	// Static maps clients (the header or claim value) to tiers. Without any lookup
+	// (Static, File or RedisHash), the claim value verified with ClaimSecret is the
+	// tier itself
+	Static map[string]string `json:"static,omitempty" yaml:"static,omitempty"`
+	// File is a local JSON file, mapping clients to tiers ({"<client>": "<tier>"}).
+	// It is read again when it changes
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+	// RedisHash is a Redis hash, mapping clients to tiers (only with the redis backend)
+	RedisHash string `json:"redisHash,omitempty" yaml:"redisHash,omitempty"`
+	// CacheTTL is the number of seconds the File and RedisHash lookups are cached.
+	// By default it is 60
+	CacheTTL int64 `json:"cacheTTL,omitempty" yaml:"cacheTTL,omitempty"`
+}
+
+type tierCacheEntry struct {
+	client    string
+	tier      string
+	expiresAt time.Time
+}
+
+// tiers gives the limit of a request, from the tier of its client
+type tiers struct {
+	header      string
+	claim       string
+	claimSecret []byte
+	plans       map[string]Limit
+	defaultTier string
+	static      map[string]string
+	file        string
+	redisHash   string
+	limiter     *Limiter
+	cacheTTL    time.Duration
+
+	mu sync.Mutex
+	// the content of the file, read again when it changes
+	fileEntries   map[string]string
+	fileModTime   time.Time
+	fileCheckedAt time.Time
+	// the Redis lookups, from the most recently used to the least recently used one
+	cache    map[string]*list.Element
+	cacheLRU *list.List
+}
+
+func newTiers(config *TiersConfig, limiter *Limiter) (*tiers, error) {
+	if config.HeaderName == "" && config.Claim == "" {
+		return nil, fmt.Errorf("tiers need a headerName or a claim")
+	}
+	if config.HeaderName != "" && config.Claim != "" {
+		return nil, fmt.Errorf("tiers headerName and claim are mutually exclusive")
+	}
+	// the client would choose its own plan otherwise
+	if config.Static == nil && config.File == "" && config.RedisHash == "" && (config.Claim == "" || config.ClaimSecret == "") {
+		return nil, fmt.Errorf("tiers need a static, file or redisHash mapping, or a claim verified with claimSecret")
+	}
+	if config.RedisHash != "" && limiter == nil {
+		return nil, fmt.Errorf("tiers redisHash is only supported by the redis backend")
+	}
+	if config.CacheTTL < 1 {
+		config.CacheTTL = 60
+	}
+
+	plans := make(map[string]Limit, len(config.Plans))
+	for name, plan := range config.Plans {
+		limit, err := newLimit(LimitConfig{
+			Average: plan.Average,
+			Burst:   plan.Burst,
+			Period:  plan.Period,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("tier %s: %v", name, err)
+		}
+		limit.Tier = name
+		plans[name] = limit
+	}
+	if _, ok := plans[config.Default]; !ok {
+		return nil, fmt.Errorf("the default tier %q is not one of the plans", config.Default)
+	}
+
+	t := &tiers{
+		header:      config.HeaderName,
+		claim:       config.Claim,
+		claimSecret: []byte(config.ClaimSecret),
+		plans:       plans,
+		defaultTier: config.Default,
+		static:      config.Static,
+		file:        config.File,
+		redisHash:   config.RedisHash,
+		limiter:     limiter,
+		cacheTTL:    time.Duration(config.CacheTTL) * time.Second,
+		cache:       map[string]*list.Element{},
+		cacheLRU:    list.New(),
+	}
+	if t.file != "" {
+		// fail early on a missing, or invalid, file
+		if err := t.readFile(time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// limit returns the limit of the tier of the client of the request
+func (t *tiers) limit(req *http.Request) Limit {
+	if limit, ok := t.plans[t.tier(t.client(req))]; ok {
+		return limit
+	}
+	return t.plans[t.defaultTier]
+}
+
+// client returns the identity of the client of the request, or ""
+func (t *tiers) client(req *http.Request) string {
+	if t.header != "" {
+		return req.Header.Get(t.header)
+	}
+	return bearerClaim(req, t.claim, t.claimSecret, time.Now())
+}
+
+// tier returns the tier of a client, or "" if it is unknown
+func (t *tiers) tier(client string) string {
+	if client == "" {
+		return ""
+	}
+	if t.static == nil && t.file == "" && t.redisHash == "" {
+		return client
+	}
+	if tier, ok := t.static[client]; ok {
+		return tier
+	}
+	if t.file != "" {
+		if tier, ok := t.fileTier(client); ok {
+			return tier
+		}
+	}
+	if t.redisHash != "" {
+		return t.redisTier(client)
+	}
+	return ""
+}
+
+func (t *tiers) fileTier(client string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.fileCheckedAt) >= t.cacheTTL {
+		// keep the previous content if the file became invalid
+		t.readFile(now)
+	}
+	tier, ok := t.fileEntries[client]
+	return tier, ok
+}
+
+// readFile reads the file again if it changed. t.mu must be held (or t not
+// shared yet)
+func (t *tiers) readFile(now time.Time) error {
+	t.fileCheckedAt = now
+
+	info, err := os.Stat(t.file)
+	if err != nil {
+		return fmt.Errorf("unable to read the tiers file: %v", err)
+	}
+	if info.ModTime().Equal(t.fileModTime) {
+		return nil
+	}
+	content, err := os.ReadFile(t.file)
+	if err != nil {
+		return fmt.Errorf("unable to read the tiers file: %v", err)
+	}
+	entries := map[string]string{}
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return fmt.Errorf("invalid tiers file: %v", err)
+	}
+	t.fileEntries = entries
+	t.fileModTime = info.ModTime()
+	return nil
+}
+
+func (t *tiers) redisTier(client string) string {
+	now := time.Now()
+	entry, ok := t.cachedTier(client)
+	if ok && now.Before(entry.expiresAt) {
+		return entry.tier
+	}
+
+	tier, err := t.limiter.HashGet(t.redisHash, client)
+	if err != nil {
+		// use the previous tier (if any) until Redis is back
+		return entry.tier
+	}
+	t.storeTier(client, tier, now.Add(t.cacheTTL))
+	return tier
+}
+
+// cachedTier returns the cached Redis lookup of a client, even expired
+func (t *tiers) cachedTier(client string) (tierCacheEntry, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elem, ok := t.cache[client]
+	if !ok {
+		return tierCacheEntry{}, false
+	}
+	t.cacheLRU.MoveToFront(elem)
+	return *elem.Value.(*tierCacheEntry), true
+}
+
+// storeTier caches a Redis lookup. When full, the least recently used entry
+// is evicted
+func (t *tiers) storeTier(client, tier string, expiresAt time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if elem, ok := t.cache[client]; ok {
+		entry := elem.Value.(*tierCacheEntry)
+		entry.tier = tier
+		entry.expiresAt = expiresAt
+		t.cacheLRU.MoveToFront(elem)
+		return
+	}
+	if len(t.cache) >= tiersCacheSize {
+		oldest := t.cacheLRU.Back()
+		t.cacheLRU.Remove(oldest)
+		delete(t.cache, oldest.Value.(*tierCacheEntry).client)
+	}
+	t.cache[client] = t.cacheLRU.PushFront(&tierCacheEntry{client: client, tier: tier, expiresAt: expiresAt})
+}
+
+// bearerClaim returns a claim of the JWT bearer token of the request, or "".
+// With a secret, the token must be signed with it (HS256), and not be expired
+func bearerClaim(req *http.Request, claim string, secret []byte, now time.Time) string {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	if len(secret) > 0 && !validSignature(parts, secret) {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	if len(secret) > 0 {
+		if exp, ok := claims["exp"].(float64); ok && now.Unix() >= int64(exp) {
+			return ""
+		}
+	}
+	switch v := claims[claim].(type) {
+	case string:
+		return v
+	case float64, bool:
+		return fmt.Sprintf("%v", v)
+	}
+	return ""
+}
+
+// validSignature reports whether the header, payload and signature parts of a
+// JWT are signed with the secret, using HS256
+func validSignature(parts []string, secret []byte) bool {
+	header, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[0], "="))
+	if err != nil {
+		return false
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	// the algorithm is not chosen by the token
+	if err := json.Unmarshal(header, &h); err != nil || h.Alg != "HS256" {
+		return false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	return hmac.Equal(signature, mac.Sum(nil))
+}
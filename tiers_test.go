@@ -0,0 +1,132 @@
+package traefik_cluster_ratelimit
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTiers(t *testing.T) {
+	plans := map[string]TierPlan{
+		"free": {Average: 10, Burst: 20},
+		"pro":  {Average: 600, Burst: 100, Period: 60},
+	}
+	_, err := newTiers(&TiersConfig{HeaderName: "X-Api-Key", Plans: plans, Default: "gold"}, nil)
+	assert.Error(t, err)
+	_, err = newTiers(&TiersConfig{HeaderName: "X-Api-Key", Plans: plans, Default: "free", RedisHash: "tiers"}, nil)
+	assert.Error(t, err)
+
+	tiers, err := newTiers(&TiersConfig{
+		HeaderName: "X-Api-Key",
+		Plans:      plans,
+		Default:    "free",
+		Static:     map[string]string{"key-1": "pro"},
+	}, nil)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Api-Key", "key-1")
+	assert.Equal(t, Limit{Rate: 600, Burst: 100, Period: time.Minute, Tier: "pro"}, tiers.limit(req))
+	req.Header.Set("X-Api-Key", "key-2")
+	assert.Equal(t, Limit{Rate: 10, Burst: 20, Period: time.Second, Tier: "free"}, tiers.limit(req))
+
+	// the client cannot choose its plan
+	_, err = newTiers(&TiersConfig{HeaderName: "X-Plan", Plans: plans, Default: "free"}, nil)
+	assert.Error(t, err)
+	_, err = newTiers(&TiersConfig{Claim: "plan", Plans: plans, Default: "free"}, nil)
+	assert.Error(t, err)
+
+	// without lookup, the verified claim is the tier
+	tiers, err = newTiers(&TiersConfig{Claim: "plan", ClaimSecret: "secret", Plans: plans, Default: "free"}, nil)
+	require.NoError(t, err)
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+signedToken(`{"alg":"HS256","typ":"JWT"}`, `{"sub":"42","plan":"pro"}`, "secret"))
+	assert.Equal(t, "pro", tiers.limit(req).Tier)
+	req.Header.Set("Authorization", "Bearer "+signedToken(`{"alg":"HS256","typ":"JWT"}`, `{"sub":"42","plan":"pro"}`, "guess"))
+	assert.Equal(t, "free", tiers.limit(req).Tier)
+	req.Header.Set("Authorization", "Bearer invalid")
+	assert.Equal(t, "free", tiers.limit(req).Tier)
+}
+
+// signedToken returns a JWT signed with the secret, using HS256
+func signedToken(header, payload, secret string) string {
+	token := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(token))
+	return token + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestBearerClaim(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	req := httptest.NewRequest("GET", "/", nil)
+
+	// unverified
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"42","plan":"pro","admin":true}`))
+	req.Header.Set("Authorization", "Bearer e30."+payload+".signature")
+	assert.Equal(t, "pro", bearerClaim(req, "plan", nil, now))
+	assert.Equal(t, "true", bearerClaim(req, "admin", nil, now))
+	assert.Equal(t, "", bearerClaim(req, "plan", []byte("secret"), now))
+
+	// verified
+	header := `{"alg":"HS256"}`
+	req.Header.Set("Authorization", "Bearer "+signedToken(header, `{"plan":"pro","exp":1700000060}`, "secret"))
+	assert.Equal(t, "pro", bearerClaim(req, "plan", []byte("secret"), now))
+	assert.Equal(t, "", bearerClaim(req, "plan", []byte("secret"), now.Add(time.Minute)))
+
+	// the algorithm is not chosen by the token
+	req.Header.Set("Authorization", "Bearer "+signedToken(`{"alg":"none"}`, `{"plan":"pro"}`, "secret"))
+	assert.Equal(t, "", bearerClaim(req, "plan", []byte("secret"), now))
+}
+
+func TestTiersCache(t *testing.T) {
+	tiers := &tiers{cache: map[string]*list.Element{}, cacheLRU: list.New()}
+	expiresAt := time.Now().Add(time.Minute)
+	for i := 0; i < tiersCacheSize; i++ {
+		tiers.storeTier(fmt.Sprintf("key-%d", i), "pro", expiresAt)
+	}
+	// used recently
+	_, ok := tiers.cachedTier("key-0")
+	assert.True(t, ok)
+
+	tiers.storeTier("new", "free", expiresAt)
+	assert.Len(t, tiers.cache, tiersCacheSize)
+	_, ok = tiers.cachedTier("key-0")
+	assert.True(t, ok)
+	_, ok = tiers.cachedTier("key-1")
+	assert.False(t, ok)
+	entry, ok := tiers.cachedTier("new")
+	assert.True(t, ok)
+	assert.Equal(t, "free", entry.tier)
+}
+
+func TestTiersFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tiers.json")
+	require.NoError(t, os.WriteFile(file, []byte(`{"key-1": "pro"}`), 0o600))
+
+	tiers, err := newTiers(&TiersConfig{
+		HeaderName: "X-Api-Key",
+		Plans:      map[string]TierPlan{"free": {Average: 10, Burst: 20}, "pro": {Average: 100, Burst: 200}},
+		Default:    "free",
+		File:       file,
+	}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "pro", tiers.tier("key-1"))
+	assert.Equal(t, "", tiers.tier("key-2"))
+
+	// the file is read again once it changed
+	require.NoError(t, os.WriteFile(file, []byte(`{"key-2": "pro"}`), 0o600))
+	require.NoError(t, os.Chtimes(file, time.Now(), time.Now().Add(time.Minute)))
+	tiers.fileCheckedAt = time.Time{}
+	assert.Equal(t, "", tiers.tier("key-1"))
+	assert.Equal(t, "pro", tiers.tier("key-2"))
+}